@@ -0,0 +1,275 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/japanese"
+)
+
+// ファイルリストを作成できるアーカイブの拡張子
+var archiveExts = []string{".tar.gz", ".tgz", ".tar", ".zip"}
+
+// p がアーカイブの拡張子の場合、その拡張子を返す。アーカイブでない場合は空文字を返す。
+func archiveExt(p string) string {
+	lower := strings.ToLower(p)
+	for _, ext := range archiveExts {
+		if strings.HasSuffix(lower, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// p がアーカイブファイルの場合 true を返す。
+func isArchivePath(p string) bool {
+	if archiveExt(p) == "" {
+		return false
+	}
+	info, err := os.Stat(p)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// アーカイブ p のエントリを配置するフォルダのパスを返す。
+// base が未指定の場合は、アーカイブのパスから拡張子を除いたパスとする。
+func archiveBaseDir(p, base string) string {
+	if base == "" {
+		base = p[:len(p)-len(archiveExt(p))]
+	}
+	return strings.TrimRight(base, `/\`)
+}
+
+// アーカイブのエントリのファイル情報
+type archiveFileInfo struct {
+	name     string
+	size     int64
+	mode     os.FileMode
+	modTime  time.Time
+	linkname string                        // シンボリックリンクのリンク先
+	open     func() (io.ReadCloser, error) // エントリの内容を読み込む。フォルダの場合は nil
+}
+
+func (i *archiveFileInfo) Name() string       { return i.name }
+func (i *archiveFileInfo) Size() int64        { return i.size }
+func (i *archiveFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *archiveFileInfo) ModTime() time.Time { return i.modTime }
+func (i *archiveFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *archiveFileInfo) Sys() interface{}   { return nil }
+
+// エントリの内容のハッシュ値を計算する。
+func (i *archiveFileInfo) hash(hashFunc func(r io.Reader) (string, error)) (string, error) {
+	rc, err := i.open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	return hashFunc(rc)
+}
+
+// アーカイブ内のエントリ名 name を UTF-8 に変換する。
+// UTF-8 として不正な場合は、Windows で作成されたアーカイブとみなし Shift_JIS から変換する。
+func decodeArchiveName(name string) string {
+	if utf8.ValidString(name) {
+		return name
+	}
+	s, err := japanese.ShiftJIS.NewDecoder().String(name)
+	if err != nil {
+		return name
+	}
+	return s
+}
+
+// アーカイブを探索する
+type archiveWalker struct {
+	base string       // エントリを配置するフォルダのパス
+	opts *walkOptions // 除外するフォルダ、階層の深さ、負荷の制限
+	fn   func(path string, info os.FileInfo) error
+	dirs map[string]bool // 出力したフォルダ
+}
+
+// アーカイブ p のエントリごとに、base 配下のパスとして fn を呼び出す。
+// アーカイブにフォルダのエントリがない場合も、フォルダを出力する。
+func walkArchive(p, base string, opts *walkOptions, fn func(path string, info os.FileInfo) error) error {
+	w := &archiveWalker{base: base, opts: opts, fn: fn, dirs: make(map[string]bool)}
+
+	switch archiveExt(p) {
+	case ".zip":
+		return w.walkZip(p)
+	case ".tar.gz", ".tgz":
+		fp, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+
+		gr, err := gzip.NewReader(bufio.NewReader(fp))
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+
+		return w.walkTar(gr)
+	default:
+		fp, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+
+		return w.walkTar(bufio.NewReader(fp))
+	}
+}
+
+func (w *archiveWalker) walkTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		info := &archiveFileInfo{
+			size:     hdr.Size,
+			mode:     hdr.FileInfo().Mode(),
+			modTime:  hdr.ModTime,
+			linkname: decodeArchiveName(hdr.Linkname),
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			// tar は先頭から順に読み込むため、fn の呼び出し中のみ内容を読み込める
+			info.open = func() (io.ReadCloser, error) {
+				return io.NopCloser(tr), nil
+			}
+		case tar.TypeDir:
+			info.size = 0
+		}
+
+		if err := w.visit(decodeArchiveName(hdr.Name), info); err != nil {
+			return err
+		}
+	}
+}
+
+func (w *archiveWalker) walkZip(p string) error {
+	zr, err := zip.OpenReader(p)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		name := f.Name
+		if f.NonUTF8 {
+			name = decodeArchiveName(name)
+		}
+
+		fi := f.FileInfo()
+		info := &archiveFileInfo{
+			size:    fi.Size(),
+			mode:    fi.Mode(),
+			modTime: f.Modified,
+		}
+		if fi.IsDir() {
+			info.size = 0
+		} else {
+			info.open = f.Open
+		}
+
+		if err := w.visit(name, info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// エントリ名 name のエントリ info を出力する。
+func (w *archiveWalker) visit(name string, info *archiveFileInfo) error {
+	name = path.Clean("/" + strings.Replace(name, `\`, "/", -1))[1:]
+	if name == "" || name == "." {
+		return nil
+	}
+	info.name = path.Base(name)
+
+	// 親フォルダ
+	parts := strings.Split(name, "/")
+	for i := 1; i < len(parts); i++ {
+		dir := strings.Join(parts[:i], "/")
+		if w.opts.excluded(parts[i-1]) {
+			return nil
+		}
+		if w.dirs[dir] {
+			continue
+		}
+		d := &archiveFileInfo{name: parts[i-1], mode: os.ModeDir | 0755, modTime: info.modTime}
+		if err := w.emit(dir, i, d); err != nil {
+			return err
+		}
+	}
+
+	if info.IsDir() {
+		if w.opts.excluded(info.name) || w.dirs[name] {
+			return nil
+		}
+	}
+	return w.emit(name, len(parts), info)
+}
+
+// 階層の深さが depth のエントリ name を fn に渡す。
+func (w *archiveWalker) emit(name string, depth int, info *archiveFileInfo) error {
+	if info.IsDir() {
+		w.dirs[name] = true
+	}
+	if w.opts.maxDepth > 0 && depth > w.opts.maxDepth {
+		return nil
+	}
+
+	w.opts.throttle.wait()
+	return w.fn(w.base+string(filepath.Separator)+filepath.FromSlash(name), info)
+}
+
+// p で指定されたファイルリストを開く。
+// アーカイブの場合は、base 配下のパスとした TEMP のファイルリストの形式で読み込む。
+func openTempFileList(p, base string) (io.ReadCloser, error) {
+	if !isArchivePath(p) {
+		return os.Open(p)
+	}
+
+	opts, err := newListOptions("", "")
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		bw := bufio.NewWriter(pw)
+		err := walkArchive(p, archiveBaseDir(p, base), &walkOptions{}, func(path string, info os.FileInfo) error {
+			s, err := opts.line(path, info)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintln(bw, s)
+			return err
+		})
+		if err == nil {
+			err = bw.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
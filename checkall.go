@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	StageTemp = "TEMP" // TEMPストレージ
+	StageSPO  = "SPO"  // SPO
+)
+
+// 段階付きのアンマッチファイル
+type StageUnmatch struct {
+	stage string // 不一致が発生した段階
+	Unmatch
+}
+
+// P-WEB → TEMP → SPO の順にファイルを追跡するワーカー
+// fileCh には P-WEB のファイルリストから生成したファイルが送信される。
+func stageWorker(fileCh <-chan File, tempMap, spoMap map[string]History, resultsCh chan<- StageUnmatch, tempOpts, spoOpts CompareOptions, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	// タスクがなくなってタスクのチェネルがcloseされるまで無限ループ
+	for f := range fileCh {
+		// P-WEB → TEMP
+		msg, note := compareDest(f, tempMap, tempOpts)
+		if msg != "" {
+			resultsCh <- StageUnmatch{StageTemp, Unmatch{f.path, msg, note}}
+			continue
+		}
+
+		// TEMP → SPO
+		// 一致した最後のスナップショットを比較元とする
+		h := tempMap[strings.ToLower(f.path)]
+		_, matched := compareHistory(f, h, tempOpts, findPolicy(tempOpts.policies, f.path))
+		v := h[matched[len(matched)-1]-1]
+		t := File{f.path, v.Size, v.DateModified, v.Hash}
+
+		// SPOへアップロードされないファイルはチェック対象外
+		if isInvalidFile(filepath.Base(t.path), t.size) {
+			continue
+		}
+
+		if msg, note := compareDest(t, spoMap, spoOpts); msg != "" {
+			resultsCh <- StageUnmatch{StageSPO, Unmatch{f.path, msg, note}}
+		}
+	}
+}
+
+// w へ段階付きのアンマッチファイルのパスを出力する(goroutineで実行される)
+func writeStageUnMatchFile(resultsCh <-chan StageUnmatch, w io.Writer, done chan<- struct{}) error {
+	// 書き出し完了を表すチャネルをクローズする
+	defer close(done)
+
+	var write uint
+	count := map[string]map[string]uint{
+		StageTemp: make(map[string]uint),
+		StageSPO:  make(map[string]uint),
+	}
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	// resultsCh が close するまで繰り返す
+	for p := range resultsCh {
+		line := fmt.Sprintf("%s,%s,%s", p.stage, p.reason, p.path)
+		if p.note != "" {
+			line += "," + p.note
+		}
+		if _, err := bw.WriteString(line + "\n"); err != nil {
+			return err
+		}
+		write += 1
+		count[p.stage][p.reason] += 1
+	}
+
+	// 結果を出力
+	fmt.Println("◆結果ファイル(OUTPUT_FILE_PATH)の書き込みを完了しました。")
+	fmt.Printf("　→出力件数 : %d\n", write)
+	fmt.Println("　→TEMP")
+	fmt.Printf("　　→ファイルなし : %d\n", count[StageTemp][UnmatchReasonNonExist])
+	fmt.Printf("　　→サイズ不一致 : %d\n", count[StageTemp][UnmatchReasonSizeUnmatch])
+	fmt.Println("　→SPO")
+	fmt.Printf("　　→ファイルなし : %d\n", count[StageSPO][UnmatchReasonNonExist])
+	fmt.Printf("　　→サイズ不一致 : %d\n", count[StageSPO][UnmatchReasonSizeUnmatch])
+	fmt.Printf("　　→サイズ縮小 : %d\n", count[StageSPO][UnmatchReasonSizeShrink])
+	fmt.Printf("　　→更新日時エラー : %d\n", count[StageSPO][UnmatchReasonDateModifiedError])
+
+	return nil
+}
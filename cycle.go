@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// リカバリサイクルでのファイルの状態
+const (
+	CycleStatusFixed     = "解消"
+	CycleStatusNew       = "新規"
+	CycleStatusFailing   = "未解消"
+	CycleStatusEscalated = "エスカレーション"
+	CycleStatusUnknown   = "未確認" // チェック結果ファイルに解析できない行があり、解消したか判定できない
+)
+
+// リカバリサイクルで追跡する1ファイル
+type CycleEntry struct {
+	Path            string `json:"path"`
+	Reason          string `json:"reason"`           // 最後のチェックでの不一致理由
+	Attempts        int    `json:"attempts"`         // 再送信した回数(再送信の対象として出力した後に、再度チェックした回数)
+	Resend          bool   `json:"resend,omitempty"` // 最後の世代で再送信の対象(新規、未解消)として出力した場合 true
+	FirstGeneration int    `json:"firstGeneration"`  // 最初に不一致となった世代
+	LastGeneration  int    `json:"lastGeneration"`   // 最後に不一致となった世代
+}
+
+// リカバリサイクルの1世代(1回のチェック)の記録
+type CycleGeneration struct {
+	Generation     int       `json:"generation"`
+	Time           time.Time `json:"time"`
+	Unmatch        string    `json:"unmatch"`        // 読み込んだチェック結果ファイルの絶対パス
+	UnmatchModTime time.Time `json:"unmatchModTime"` // 読み込んだチェック結果ファイルの更新日時
+	UnmatchSize    int64     `json:"unmatchSize"`    // 読み込んだチェック結果ファイルのサイズ
+	Skipped        uint      `json:"skipped"`        // 解析できずにスキップした行数
+	Fixed          uint      `json:"fixed"`
+	New            uint      `json:"new"`
+	Failing        uint      `json:"failing"`
+	Escalated      uint      `json:"escalated"`
+	Unknown        uint      `json:"unknown,omitempty"`
+}
+
+// チェック結果ファイル path の世代の記録を生成する。世代の番号と判定結果の件数は、状態への反映時に設定する。
+// info は path のファイル情報とする。
+func newCycleGeneration(path string, info os.FileInfo) (CycleGeneration, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return CycleGeneration{}, err
+	}
+	return CycleGeneration{Unmatch: abs, UnmatchModTime: info.ModTime(), UnmatchSize: info.Size()}, nil
+}
+
+// リカバリサイクルの状態ファイル
+type CycleState struct {
+	path        string
+	Generations []CycleGeneration      `json:"generations"`
+	Files       map[string]*CycleEntry `json:"files"` // 小文字のファイルパスごとの、不一致となっているファイル
+}
+
+// リカバリサイクルでの1ファイルの判定結果
+type CycleResult struct {
+	status   string
+	attempts int
+	UnmatchRow
+}
+
+// path で指定された状態ファイルを読み込む。ファイルが存在しない場合は空の状態とする。
+func loadCycleState(path string) (*CycleState, error) {
+	s := &CycleState{path: path, Files: make(map[string]*CycleEntry)}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("状態ファイルのフォーマット不正. %s", err)
+	}
+	if s.Files == nil {
+		s.Files = make(map[string]*CycleEntry)
+	}
+	return s, nil
+}
+
+// 状態ファイルを保存する。書き込み途中で中断しても壊れないように、一時ファイルに書き込んでから置き換える。
+func (s *CycleState) save() error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// r で指定されたチェック結果ファイルを読み込む。同じファイルの2行目以降と、解析できない行はスキップする。
+// 戻り値は、不一致の行、読み込み件数、スキップ件数、スキップ件数のうち解析できなかった行数。
+func readUnmatchRows(r io.Reader) ([]UnmatchRow, uint, uint, uint, error) {
+	var rows []UnmatchRow
+	var read, skip, invalid uint
+	added := make(map[string]bool)
+
+	s := bufio.NewScanner(newBufioReader(r))
+	for s.Scan() {
+		read += 1
+		if s.Text() == "" {
+			skip += 1
+			continue
+		}
+
+		row, err := parseUnmatchLine(s.Text())
+		if err != nil {
+			fmt.Println(err)
+			skip += 1
+			invalid += 1
+			continue
+		}
+		if added[strings.ToLower(row.path)] {
+			skip += 1
+			continue
+		}
+		added[strings.ToLower(row.path)] = true
+
+		rows = append(rows, row)
+	}
+
+	if s.Err() != nil {
+		// non-EOF error.
+		return nil, read, skip, invalid, s.Err()
+	}
+
+	return rows, read, skip, invalid, nil
+}
+
+// 世代 g と同じチェック結果ファイル(パス、更新日時、サイズが同じ)を記録済みの場合、その世代を返す。
+// 同じチェック結果ファイルを再度読み込むと、再送信していないファイルの再送信回数を加算してしまうため、呼び出し元でエラーとする。
+func (s *CycleState) recorded(g CycleGeneration) (int, bool) {
+	for _, v := range s.Generations {
+		if v.Unmatch == g.Unmatch && v.UnmatchModTime.Equal(g.UnmatchModTime) && v.UnmatchSize == g.UnmatchSize {
+			return v.Generation, true
+		}
+	}
+	return 0, false
+}
+
+// 最新のチェック結果 rows を新しい世代 g として状態に反映し、ファイルごとの判定結果を返す。
+// 前の世代で不一致だったファイルが rows にない場合は解消とし、状態から削除する。
+// ただし、チェック結果ファイルに解析できない行があった場合(g.Skipped > 0)は、解消したか判定できないため、
+// 未確認として状態に残す。
+// rows のファイルは、前の世代で不一致でなければ新規、不一致であれば未解消とする。
+// 再送信の回数は、前の世代で再送信の対象として出力した場合のみ加算する。
+// 再送信の回数が maxAttempts 以上のファイルはエスカレーションとする。
+// 判定結果は rows の順とし、解消(または未確認)のファイルはその後にパスの昇順で追加する。
+func (s *CycleState) next(rows []UnmatchRow, maxAttempts int, g CycleGeneration) []CycleResult {
+	g.Generation, g.Time = len(s.Generations)+1, time.Now()
+
+	var results []CycleResult
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		key := strings.ToLower(row.path)
+		seen[key] = true
+
+		e, ok := s.Files[key]
+		if !ok {
+			e = &CycleEntry{Path: row.path, FirstGeneration: g.Generation}
+			s.Files[key] = e
+		} else if e.Resend {
+			e.Attempts += 1
+		}
+		e.Reason = row.reason
+		e.LastGeneration = g.Generation
+
+		status := CycleStatusFailing
+		switch {
+		case e.Attempts >= maxAttempts:
+			status = CycleStatusEscalated
+			g.Escalated += 1
+		case !ok:
+			status = CycleStatusNew
+			g.New += 1
+		default:
+			g.Failing += 1
+		}
+		e.Resend = status != CycleStatusEscalated
+		results = append(results, CycleResult{status, e.Attempts, row})
+	}
+
+	var fixed []string
+	for key := range s.Files {
+		if !seen[key] {
+			fixed = append(fixed, key)
+		}
+	}
+	sort.Strings(fixed)
+	for _, key := range fixed {
+		e := s.Files[key]
+		row := UnmatchRow{"", Unmatch{e.Path, e.Reason, ""}}
+		if g.Skipped > 0 {
+			e.Resend = false
+			results = append(results, CycleResult{CycleStatusUnknown, e.Attempts, row})
+			g.Unknown += 1
+			continue
+		}
+		results = append(results, CycleResult{CycleStatusFixed, e.Attempts, row})
+		delete(s.Files, key)
+		g.Fixed += 1
+	}
+
+	s.Generations = append(s.Generations, g)
+	return results
+}
+
+// 判定結果 results を出力する。
+// w には再送信の対象(新規と未解消)の行をチェック結果ファイルの形式で、escalationW にはエスカレーションの行を、
+// reportW にはすべての判定結果を出力する。escalationW と reportW の1行の構成は次の通り。
+// 状態,再送信回数,チェック結果ファイルの行
+func writeCycleResults(results []CycleResult, w, escalationW, reportW io.Writer) error {
+	counts := make(map[string]uint)
+
+	bw := bufio.NewWriter(w)
+	ebw := bufio.NewWriter(escalationW)
+	rbw := bufio.NewWriter(reportW)
+	for _, r := range results {
+		counts[r.status] += 1
+
+		line := fmt.Sprintf("%s,%d,%s\n", r.status, r.attempts, r.line())
+		if _, err := rbw.WriteString(line); err != nil {
+			return err
+		}
+
+		var err error
+		switch r.status {
+		case CycleStatusNew, CycleStatusFailing:
+			_, err = bw.WriteString(r.line() + "\n")
+		case CycleStatusEscalated:
+			_, err = ebw.WriteString(line)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, b := range []*bufio.Writer{bw, ebw, rbw} {
+		if err := b.Flush(); err != nil {
+			return err
+		}
+	}
+
+	// 結果を出力
+	fmt.Println("◆サイクル結果ファイル(OUTPUT_FILE_PATH, ESCALATION_FILE_PATH, REPORT_FILE_PATH)の書き込みを完了しました。")
+	fmt.Printf("　→再送信対象件数 : %d\n", counts[CycleStatusNew]+counts[CycleStatusFailing])
+	for _, status := range []string{CycleStatusFixed, CycleStatusNew, CycleStatusFailing, CycleStatusEscalated, CycleStatusUnknown} {
+		fmt.Printf("　→%s : %d\n", status, counts[status])
+	}
+
+	return nil
+}
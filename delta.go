@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// P-WEB のファイルリストの1行
+type PJFileListLine struct {
+	line string // 読み込んだ行
+	size int    // ファイルサイズ
+}
+
+// P-WEB のファイルリストの1行 line から、検索用のキー(小文字のファイルパス)とファイルサイズを返す。
+// line の構成は次の通り。
+// "プロジェクト名","カテゴリ","サブカテゴリ",ファイルパス,ファイルサイズ
+func parsePJFileListLine(line string) (string, int, error) {
+	ary := strings.Split(line, ",")
+	if len(ary) < 5 {
+		return "", 0, fmt.Errorf("ファイルリストのフォーマット不正. len=%d, line=%s", len(ary), line)
+	}
+
+	p := strings.Replace(strings.Join(ary[0:4], "/"), "\"", "", -1)
+	size, _ := strconv.Atoi(ary[4])
+
+	return strings.ToLower(p), size, nil
+}
+
+// r で指定された P-WEB のファイルリストを読み込み、キーごとの行と、読み込んだ順のキーを返す。
+func readPJFileList(r io.Reader) (map[string]PJFileListLine, []string, error) {
+	m := make(map[string]PJFileListLine)
+	var keys []string
+
+	s := bufio.NewScanner(newBufioReader(r))
+	for s.Scan() {
+		if s.Text() == "" {
+			continue
+		}
+		key, size, err := parsePJFileListLine(s.Text())
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := m[key]; !ok {
+			keys = append(keys, key)
+		}
+		m[key] = PJFileListLine{s.Text(), size}
+	}
+
+	if s.Err() != nil {
+		// non-EOF error.
+		return nil, nil, s.Err()
+	}
+
+	return m, keys, nil
+}
+
+// 旧ファイルリスト oldR と新ファイルリスト newR を比較し、
+// 追加または変更(ファイルサイズ)されたファイルの行を w へ、削除されたファイルの行を deletedW へ出力する。
+// 出力する行は、読み込んだ P-WEB のファイルリストの行のままとする。
+func writePJFileListDelta(oldR, newR io.Reader, w, deletedW io.Writer) error {
+	oldMap, oldKeys, err := readPJFileList(oldR)
+	if err != nil {
+		return err
+	}
+	newMap, newKeys, err := readPJFileList(newR)
+	if err != nil {
+		return err
+	}
+
+	var added, changed, unchanged, deleted uint
+
+	bw := bufio.NewWriter(w)
+	for _, key := range newKeys {
+		n := newMap[key]
+		o, ok := oldMap[key]
+		switch {
+		case !ok:
+			added += 1
+		case o.size != n.size:
+			changed += 1
+		default:
+			unchanged += 1
+			continue
+		}
+		if _, err := bw.WriteString(n.line + "\n"); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	dbw := bufio.NewWriter(deletedW)
+	for _, key := range oldKeys {
+		if _, ok := newMap[key]; ok {
+			continue
+		}
+		deleted += 1
+		if _, err := dbw.WriteString(oldMap[key].line + "\n"); err != nil {
+			return err
+		}
+	}
+	if err := dbw.Flush(); err != nil {
+		return err
+	}
+
+	// 結果を出力
+	fmt.Println("◆差分ファイル(OUTPUT_FILE_PATH, DELETED_FILE_PATH)の書き込みを完了しました。")
+	fmt.Printf("　→追加件数 : %d\n", added)
+	fmt.Printf("　→変更件数 : %d\n", changed)
+	fmt.Printf("　→変更なし件数 : %d\n", unchanged)
+	fmt.Printf("　→削除件数 : %d\n", deleted)
+
+	return nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// diff-list コマンドで比較できるファイルリストの形式
+const (
+	listFormatTemp = "temp" // TEMP のファイルリスト(list コマンドの出力)
+	listFormatSPO  = "spo"  // SPO のファイルリスト
+	listFormatPWeb = "pweb" // P-WEB のファイルリスト
+)
+
+// ファイルリストの差分の区分
+const (
+	DiffKindAdded   = "追加"
+	DiffKindRemoved = "削除"
+	DiffKindResized = "サイズ変更"
+	DiffKindRedated = "更新日時変更"
+)
+
+// 差分に出力する更新日時のフォーマット
+const diffDateTimeFormat = "2006/01/02 15:04:05"
+
+// ファイルリストの差分
+type ListDiff struct {
+	kind string
+	path string
+	old  *SizeAndDateModified // 追加の場合は nil
+	new  *SizeAndDateModified // 削除の場合は nil
+}
+
+// フォルダごとの差分の集計
+type FolderDiff struct {
+	path                             string
+	added, removed, resized, redated uint
+	sizeDelta                        int64 // 増減したバイト数
+}
+
+// format 形式の旧ファイルリスト oldPath と新ファイルリスト newPath を読み込み、
+// 旧を1番目、新を2番目のスナップショットとしたマップを生成する。
+// prefix と sd は、SPO と P-WEB のファイルリストのパスの生成に使用する。
+func generateDiffMap(format, oldPath, newPath, prefix, sd string) (map[string]History, error) {
+	m := make(map[string]History)
+
+	for i, p := range []string{oldPath, newPath} {
+		switch format {
+		case listFormatTemp:
+			if err := generateDestMapFromTempFileListPathAt(m, p, "", i, 2); err != nil {
+				return nil, err
+			}
+		case listFormatSPO:
+			spoMap, err := generateDestMapFromSPOFileListPath(p, prefix, sd)
+			if err != nil {
+				return nil, err
+			}
+			for k, v := range spoMap {
+				h, ok := m[k]
+				if !ok {
+					h = make(History, 2)
+					m[k] = h
+				}
+				h[i] = v.Latest()
+			}
+		case listFormatPWeb:
+			fp, err := os.Open(p)
+			if err != nil {
+				return nil, err
+			}
+			for f := range generateSourceFromPJFileList(fp, prefix, "") {
+				k := strings.ToLower(f.path)
+				h, ok := m[k]
+				if !ok {
+					h = make(History, 2)
+					m[k] = h
+				}
+				h[i] = &SizeAndDateModified{f.size, f.dateModified, "", f.path}
+			}
+			fp.Close()
+		default:
+			return nil, fmt.Errorf("ファイルリストの形式が不正です. FORMAT=%s", format)
+		}
+	}
+
+	return m, nil
+}
+
+// 旧と新のスナップショットを持つ m から、パスの昇順に差分を生成する。
+func diffLists(m map[string]History) []ListDiff {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var diffs []ListDiff
+	for _, k := range keys {
+		o, n := m[k][0], m[k][1]
+		switch {
+		case o == nil:
+			diffs = append(diffs, ListDiff{DiffKindAdded, n.Path, nil, n})
+		case n == nil:
+			diffs = append(diffs, ListDiff{DiffKindRemoved, o.Path, o, nil})
+		case o.Size != n.Size:
+			diffs = append(diffs, ListDiff{DiffKindResized, n.Path, o, n})
+		case !o.DateModified.Equal(n.DateModified):
+			diffs = append(diffs, ListDiff{DiffKindRedated, n.Path, o, n})
+		}
+	}
+	return diffs
+}
+
+// 差分 diffs を、ファイルの格納フォルダとその上位のすべてのフォルダごとに、フォルダのパスの昇順で集計する。
+func rollupListDiffs(diffs []ListDiff) []*FolderDiff {
+	folders := make(map[string]*FolderDiff)
+	var keys []string
+	for _, d := range diffs {
+		for dir := path.Dir(d.path); ; dir = path.Dir(dir) {
+			k := strings.ToLower(dir)
+			f, ok := folders[k]
+			if !ok {
+				f = &FolderDiff{path: dir}
+				folders[k] = f
+				keys = append(keys, k)
+			}
+			f.add(d)
+
+			// ルート(「/」、「C:」など)に到達した場合は終了する
+			if parent := path.Dir(dir); parent == dir || parent == "." {
+				break
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	rollup := make([]*FolderDiff, len(keys))
+	for i, k := range keys {
+		rollup[i] = folders[k]
+	}
+	return rollup
+}
+
+// 差分 d を集計に加算する。
+func (f *FolderDiff) add(d ListDiff) {
+	switch d.kind {
+	case DiffKindAdded:
+		f.added += 1
+	case DiffKindRemoved:
+		f.removed += 1
+	case DiffKindResized:
+		f.resized += 1
+	case DiffKindRedated:
+		f.redated += 1
+	}
+	f.sizeDelta += d.sizeDelta()
+}
+
+// 差分によって増減したバイト数を返す。
+func (d ListDiff) sizeDelta() int64 {
+	var delta int64
+	if d.new != nil {
+		delta += int64(d.new.Size)
+	}
+	if d.old != nil {
+		delta -= int64(d.old.Size)
+	}
+	return delta
+}
+
+// 差分の1行を生成する。1行の構成は次の通り。
+// 区分,"ファイルパス",旧ファイルサイズ,新ファイルサイズ,旧更新日時,新更新日時
+func (d ListDiff) line() string {
+	return fmt.Sprintf("%s,\"%s\",%s,%s,%s,%s", d.kind, d.path, diffSize(d.old), diffSize(d.new), diffDateModified(d.old), diffDateModified(d.new))
+}
+
+func diffSize(v *SizeAndDateModified) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v.Size)
+}
+
+func diffDateModified(v *SizeAndDateModified) string {
+	if v == nil || v.DateModified.IsZero() {
+		return ""
+	}
+	return v.DateModified.Format(diffDateTimeFormat)
+}
+
+// w へ差分 diffs を出力する。
+func writeListDiffs(diffs []ListDiff, w io.Writer) error {
+	var added, removed, resized, redated uint
+
+	bw := bufio.NewWriter(w)
+	for _, d := range diffs {
+		if _, err := bw.WriteString(d.line() + "\n"); err != nil {
+			return err
+		}
+		switch d.kind {
+		case DiffKindAdded:
+			added += 1
+		case DiffKindRemoved:
+			removed += 1
+		case DiffKindResized:
+			resized += 1
+		case DiffKindRedated:
+			redated += 1
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	// 結果を出力
+	fmt.Println("◆差分ファイル(OUTPUT_FILE_PATH)の書き込みを完了しました。")
+	fmt.Printf("　→出力件数 : %d\n", len(diffs))
+	fmt.Printf("　→%s : %d\n", DiffKindAdded, added)
+	fmt.Printf("　→%s : %d\n", DiffKindRemoved, removed)
+	fmt.Printf("　→%s : %d\n", DiffKindResized, resized)
+	fmt.Printf("　→%s : %d\n", DiffKindRedated, redated)
+
+	return nil
+}
+
+// w へフォルダごとの集計 rollup を出力する。1行の構成は次の通り。
+// "フォルダのパス",追加件数,削除件数,サイズ変更件数,更新日時変更件数,増減バイト数
+func writeFolderDiffs(rollup []*FolderDiff, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range rollup {
+		if _, err := fmt.Fprintf(bw, "\"%s\",%d,%d,%d,%d,%d\n", f.path, f.added, f.removed, f.resized, f.redated, f.sizeDelta); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println("◆フォルダ集計ファイル(ROLLUP_FILE_PATH)の書き込みを完了しました。")
+	fmt.Printf("　→出力件数 : %d\n", len(rollup))
+
+	return nil
+}
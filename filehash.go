@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	hashAlgorithmQuickXor = "quickxor"
+	hashAlgorithmSHA1     = "sha1"
+	hashAlgorithmSHA256   = "sha256"
+)
+
+const UnmatchReasonHashUnmatch = "ハッシュ不一致"
+
+// alg で指定されたアルゴリズムのハッシュ値を計算する関数を返す。
+func newHashFunc(alg string) (func(r io.Reader) (string, error), error) {
+	var h func() hash.Hash
+	encode := hex.EncodeToString
+	switch alg {
+	case hashAlgorithmQuickXor:
+		// SPO と同じく BASE64 で出力する
+		h = newQuickXorHash
+		encode = base64.StdEncoding.EncodeToString
+	case hashAlgorithmSHA1:
+		h = sha1.New
+	case hashAlgorithmSHA256:
+		h = sha256.New
+	default:
+		return nil, fmt.Errorf("ハッシュアルゴリズムが不正です. HASH=%s", alg)
+	}
+
+	return func(r io.Reader) (string, error) {
+		w := h()
+		if _, err := io.Copy(w, r); err != nil {
+			return "", err
+		}
+		return encode(w.Sum(nil)), nil
+	}, nil
+}
+
+// path で指定されたファイルのハッシュ値を計算する。
+func hashFile(path string, hashFunc func(r io.Reader) (string, error)) (string, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+
+	return hashFunc(fp)
+}
+
+// ハッシュ値 v の形式からアルゴリズムを判定する。判定できない場合は空文字を返す。
+func hashAlgorithmOf(v string) string {
+	switch len(v) {
+	case base64.StdEncoding.EncodedLen(quickXorSize):
+		if _, err := base64.StdEncoding.DecodeString(v); err == nil {
+			return hashAlgorithmQuickXor
+		}
+	case hex.EncodedLen(sha1.Size):
+		if _, err := hex.DecodeString(v); err == nil {
+			return hashAlgorithmSHA1
+		}
+	case hex.EncodedLen(sha256.Size):
+		if _, err := hex.DecodeString(v); err == nil {
+			return hashAlgorithmSHA256
+		}
+	}
+	return ""
+}
+
+// 比較元と比較先のハッシュ値を比較する。
+// 同じアルゴリズムのハッシュ値が両方にある場合は ok に true を返し、一致する場合は match に true を返す。
+func compareHash(a, b string) (match, ok bool) {
+	alg := hashAlgorithmOf(a)
+	if alg == "" || alg != hashAlgorithmOf(b) {
+		return false, false
+	}
+	if alg == hashAlgorithmQuickXor {
+		return a == b, true
+	}
+	// 16進数は大文字小文字を区別しない
+	return strings.EqualFold(a, b), true
+}
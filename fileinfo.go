@@ -0,0 +1,15 @@
+package main
+
+import "time"
+
+// OS 固有のファイル情報
+type sysFileInfo struct {
+	ctime    time.Time // ctime(Windowsの場合は作成日時)
+	hasID    bool      // デバイス番号、inode番号、ハードリンク数を取得できた場合 true
+	dev      uint64    // デバイス番号
+	ino      uint64    // inode番号
+	nlink    uint64    // ハードリンク数
+	hasOwner bool      // 所有者を取得できた場合 true
+	uid      string    // 所有者のID
+	gid      string    // グループのID
+}
@@ -0,0 +1,30 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// info から OS 固有のファイル情報を取得する。
+func getSysFileInfo(info os.FileInfo) sysFileInfo {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return sysFileInfo{}
+	}
+
+	return sysFileInfo{
+		ctime:    time.Unix(int64(st.Ctim.Sec), int64(st.Ctim.Nsec)),
+		hasID:    true,
+		dev:      uint64(st.Dev),
+		ino:      uint64(st.Ino),
+		nlink:    uint64(st.Nlink),
+		hasOwner: true,
+		uid:      strconv.FormatUint(uint64(st.Uid), 10),
+		gid:      strconv.FormatUint(uint64(st.Gid), 10),
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import "os"
+
+// info から OS 固有のファイル情報を取得する。Linux、Windows 以外は取得しない。
+func getSysFileInfo(info os.FileInfo) sysFileInfo {
+	return sysFileInfo{}
+}
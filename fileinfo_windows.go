@@ -0,0 +1,23 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// info から OS 固有のファイル情報を取得する。
+// Windows の場合は ctime の代わりに作成日時を返す。inode 番号と所有者は取得しない。
+func getSysFileInfo(info os.FileInfo) sysFileInfo {
+	d, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return sysFileInfo{}
+	}
+
+	return sysFileInfo{
+		ctime: time.Unix(0, d.CreationTime.Nanoseconds()),
+	}
+}
@@ -5,6 +5,7 @@ go 1.17
 require (
 	github.com/saracen/walker v0.1.2
 	github.com/urfave/cli/v2 v2.3.0
+	golang.org/x/text v0.3.7
 )
 
 require (
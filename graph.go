@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Microsoft Graph の既定のエンドポイント
+const defaultGraphEndpoint = "https://graph.microsoft.com/v1.0"
+
+// 単純なアップロード(PUT)で送信するファイルサイズの上限
+const graphSimpleUploadLimit = 4 * 1024 * 1024
+
+// アップロードセッションで送信するチャンクの単位。チャンクのサイズはこの倍数とする
+const graphChunkUnit = 320 * 1024
+
+// アップロードセッションで送信するチャンクのサイズ(10MiB 未満で最大の 320KiB の倍数)
+const graphChunkSize = 32 * graphChunkUnit
+
+// 再試行の待機時間の上限
+const graphMaxBackoff = 60 * time.Second
+
+// Microsoft Graph(または互換のエンドポイント)へのアップロードを行うクライアント
+type GraphClient struct {
+	endpoint   string // API のエンドポイント(例: https://graph.microsoft.com/v1.0)
+	token      string // アクセストークン
+	driveID    string // 送信先のライブラリのドライブID
+	maxRetries int    // 再試行の回数
+	client     *http.Client
+}
+
+// GraphClient を生成する。
+func newGraphClient(endpoint, token, driveID string, maxRetries int) (*GraphClient, error) {
+	if token == "" {
+		return nil, fmt.Errorf("アクセストークン(GRAPH_TOKEN)を指定してください")
+	}
+	if driveID == "" {
+		return nil, fmt.Errorf("ドライブID(DRIVE_ID)を指定してください")
+	}
+	return &GraphClient{strings.TrimRight(endpoint, "/"), token, driveID, maxRetries, &http.Client{Timeout: 10 * time.Minute}}, nil
+}
+
+// ドライブのルートからのパス target のアイテムの URL を返す。
+func (c *GraphClient) itemURL(target string) string {
+	return fmt.Sprintf("%s/drives/%s/root:/%s:", c.endpoint, url.PathEscape(c.driveID), graphPathEscape(target))
+}
+
+// 再試行が必要なステータスコードの場合 true を返す。
+func isGraphRetryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// 応答の Retry-After(秒数または HTTP 日付)から待機時間を返す。指定がない場合は false を返す。
+// 日時が過ぎている場合は、待機時間を 0 とする。
+func graphRetryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+		return time.Duration(sec) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if d := time.Until(t); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// newRequest で生成したリクエストを送信する。
+// attempt 回目(0始まり)の再試行までの待機時間を返す。1秒から倍々に延ばし、graphMaxBackoff を上限とする。
+func graphBackoff(attempt int) time.Duration {
+	// 再試行の回数が多い場合にオーバーフローしないように、上限に達した時点で延ばすのをやめる
+	wait := time.Second
+	for i := 0; i < attempt && wait < graphMaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > graphMaxBackoff {
+		wait = graphMaxBackoff
+	}
+	return wait
+}
+
+// 通信エラー、429(Too Many Requests)、5xx の場合は、Retry-After または指数関数的に延ばした時間だけ待機して再試行する。
+// 再試行の回数を超えた場合は、最後の応答(通信エラーの場合はエラー)を返す。
+func (c *GraphClient) do(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.client.Do(req)
+		if err == nil && !isGraphRetryable(resp.StatusCode) {
+			return resp, nil
+		}
+		if attempt >= c.maxRetries {
+			return resp, err
+		}
+
+		wait := graphBackoff(attempt)
+		if err == nil {
+			if ra, ok := graphRetryAfter(resp); ok {
+				wait = ra
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		time.Sleep(wait)
+	}
+}
+
+// アクセストークンを付加したリクエストを生成する。
+func (c *GraphClient) newRequest(method, u string, body []byte, contentType string) (*http.Request, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return req, nil
+}
+
+// 成功以外の応答からエラーを生成する。応答の本文が Graph のエラーの場合は、そのメッセージを含める。
+func graphResponseError(resp *http.Response) error {
+	var e struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if json.Unmarshal(b, &e) == nil && e.Error.Code != "" {
+		return fmt.Errorf("Graph API エラー. status=%d, code=%s, message=%s", resp.StatusCode, e.Error.Code, e.Error.Message)
+	}
+	return fmt.Errorf("Graph API エラー. status=%d", resp.StatusCode)
+}
+
+// 応答の本文を JSON として v に読み込む。成功以外の応答の場合はエラーを返す。
+func decodeGraphResponse(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return graphResponseError(resp)
+	}
+	if v == nil {
+		_, err := io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// ファイル p の内容を、単純なアップロード(PUT)で target へ送信する。同名のファイルは置き換える。
+func (c *GraphClient) uploadSmall(p, target string) error {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	u := c.itemURL(target) + "/content?@microsoft.graph.conflictBehavior=replace"
+	resp, err := c.do(func() (*http.Request, error) {
+		return c.newRequest(http.MethodPut, u, b, "application/octet-stream")
+	})
+	if err != nil {
+		return err
+	}
+	return decodeGraphResponse(resp, nil)
+}
+
+// target へのアップロードセッションを作成し、送信先の URL を返す。同名のファイルは置き換える。
+func (c *GraphClient) createUploadSession(target string) (string, error) {
+	body := []byte(`{"item":{"@microsoft.graph.conflictBehavior":"replace"}}`)
+	resp, err := c.do(func() (*http.Request, error) {
+		return c.newRequest(http.MethodPost, c.itemURL(target)+"/createUploadSession", body, "application/json")
+	})
+	if err != nil {
+		return "", err
+	}
+	var session struct {
+		UploadURL string `json:"uploadUrl"`
+	}
+	if err := decodeGraphResponse(resp, &session); err != nil {
+		return "", err
+	}
+	if session.UploadURL == "" {
+		return "", fmt.Errorf("アップロードセッションの URL が取得できません. target=%s", target)
+	}
+	return session.UploadURL, nil
+}
+
+// アップロードセッションの次に送信する位置を返す。セッションが失効している場合は -1 を返す。
+func (c *GraphClient) uploadSessionOffset(uploadURL string) (int64, error) {
+	resp, err := c.do(func() (*http.Request, error) {
+		// アップロードセッションの URL は認証済みのため、アクセストークンを付加しない
+		return http.NewRequest(http.MethodGet, uploadURL, nil)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return -1, nil
+	}
+	var status struct {
+		NextExpectedRanges []string `json:"nextExpectedRanges"`
+	}
+	if err := decodeGraphResponse(resp, &status); err != nil {
+		return 0, err
+	}
+	if len(status.NextExpectedRanges) == 0 {
+		return 0, nil
+	}
+	start := strings.SplitN(status.NextExpectedRanges[0], "-", 2)[0]
+	return strconv.ParseInt(start, 10, 64)
+}
+
+// ファイル f(サイズ size)の offset 以降を、アップロードセッション uploadURL へチャンクごとに送信する。
+// チャンクを送信するたびに、送信済みの位置を progress へ通知する。
+// 416(Requested Range Not Satisfiable)の場合は、受信済みの位置を問い合わせて、その位置から送信し直す。
+func (c *GraphClient) uploadChunks(f *os.File, size, offset int64, uploadURL string, progress func(int64) error) error {
+	buf := make([]byte, graphChunkSize)
+	for offset < size {
+		n, err := f.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("ファイルサイズが変更されています. size=%d, offset=%d", size, offset)
+		}
+		chunk := buf[:n]
+		contentRange := fmt.Sprintf("bytes %d-%d/%d", offset, offset+int64(n)-1, size)
+
+		resp, err := c.do(func() (*http.Request, error) {
+			// アップロードセッションの URL は認証済みのため、アクセストークンを付加しない
+			req, err := http.NewRequest(http.MethodPut, uploadURL, bytes.NewReader(chunk))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Range", contentRange)
+			return req, nil
+		})
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			resp.Body.Close()
+			next, err := c.uploadSessionOffset(uploadURL)
+			if err != nil {
+				return err
+			}
+			// 同じ位置を繰り返し送信しないように、位置が変わらない場合はエラーとする
+			if next < 0 || next == offset {
+				return fmt.Errorf("アップロードセッションの受信済みの位置を取得できません. offset=%d", offset)
+			}
+			offset = next
+		} else {
+			if err := decodeGraphResponse(resp, nil); err != nil {
+				return err
+			}
+			offset += int64(n)
+		}
+
+		if err := progress(offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// アップロードの再開に使用する1ファイルの状態
+type GraphUploadEntry struct {
+	Target    string    `json:"target"`              // 送信先のドライブのルートからのパス
+	Size      int64     `json:"size"`                // 送信を開始したときのファイルサイズ
+	Mtime     time.Time `json:"mtime"`               // 送信を開始したときの更新日時
+	Done      bool      `json:"done"`                // 送信が完了した場合 true
+	UploadURL string    `json:"uploadUrl,omitempty"` // 送信中のアップロードセッションの URL
+	Offset    int64     `json:"offset,omitempty"`    // アップロードセッションの送信済みの位置
+}
+
+// 状態が、送信先 target、ファイル情報 info のファイルのものである場合 true を返す。
+func (e *GraphUploadEntry) matches(target string, info os.FileInfo) bool {
+	return e.Target == target && e.Size == info.Size() && e.Mtime.Equal(info.ModTime())
+}
+
+// アップロードの再開に使用する状態ファイル
+type GraphUploadState struct {
+	path  string
+	Files map[string]*GraphUploadEntry `json:"files"` // 送信するファイルのパスごとの状態
+}
+
+// path で指定された状態ファイルを読み込む。ファイルが存在しない場合は空の状態とする。
+func loadGraphUploadState(path string) (*GraphUploadState, error) {
+	s := &GraphUploadState{path: path, Files: make(map[string]*GraphUploadEntry)}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("状態ファイルのフォーマット不正. %s", err)
+	}
+	if s.Files == nil {
+		s.Files = make(map[string]*GraphUploadEntry)
+	}
+	return s, nil
+}
+
+// 状態ファイルを保存する。書き込み途中で中断しても壊れないように、一時ファイルに書き込んでから置き換える。
+func (s *GraphUploadState) save() error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// アップロードの結果
+const (
+	GraphUploadSuccess = "Success"
+	GraphUploadFailure = "Failure"
+	GraphUploadSkipped = "Skipped" // 状態ファイルで送信済みのため送信しない
+)
+
+// 1ファイルを送信する。状態ファイルで送信済みの場合は送信しない。
+// 送信中のアップロードセッションがある場合は、送信済みの位置から再開する。
+// 送信先、ファイルサイズ、更新日時のいずれかが状態ファイルと異なる場合は、最初から送信する。
+func (c *GraphClient) upload(item RecoveryItem, state *GraphUploadState) (string, error) {
+	target := graphTarget(item)
+
+	info, err := os.Stat(item.Path)
+	if err != nil {
+		return GraphUploadFailure, err
+	}
+
+	e, ok := state.Files[item.Path]
+	if ok && e.Done && e.matches(target, info) {
+		return GraphUploadSkipped, nil
+	}
+	if !ok || !e.matches(target, info) {
+		e = &GraphUploadEntry{Target: target, Size: info.Size(), Mtime: info.ModTime()}
+		state.Files[item.Path] = e
+	}
+
+	if info.Size() <= graphSimpleUploadLimit {
+		if err := c.uploadSmall(item.Path, target); err != nil {
+			return GraphUploadFailure, err
+		}
+	} else {
+		if err := c.uploadLarge(item.Path, e, state); err != nil {
+			return GraphUploadFailure, err
+		}
+	}
+
+	e.Done, e.UploadURL, e.Offset = true, "", 0
+	return GraphUploadSuccess, state.save()
+}
+
+// ファイル p を、アップロードセッションを使用して e.Target へ送信する。
+func (c *GraphClient) uploadLarge(p string, e *GraphUploadEntry, state *GraphUploadState) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// 送信中のアップロードセッションがあれば、サーバーの受信済みの位置から再開する
+	offset := int64(-1)
+	if e.UploadURL != "" {
+		if offset, err = c.uploadSessionOffset(e.UploadURL); err != nil {
+			return err
+		}
+	}
+	if offset < 0 {
+		if e.UploadURL, err = c.createUploadSession(e.Target); err != nil {
+			return err
+		}
+		offset = 0
+	}
+	e.Offset = offset
+	if err := state.save(); err != nil {
+		return err
+	}
+
+	return c.uploadChunks(f, e.Size, offset, e.UploadURL, func(n int64) error {
+		e.Offset = n
+		return state.save()
+	})
+}
+
+// items を順に送信し、w へ結果を出力する。1行の構成は次の通り。
+// 結果,"ファイルパス","送信先のパス","メッセージ"
+// 送信に失敗したファイルがある場合は、すべてのファイルを処理した後にエラーを返す。
+func executeGraphUploads(c *GraphClient, items []RecoveryItem, state *GraphUploadState, w io.Writer) error {
+	counts := make(map[string]uint)
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	if _, err := bw.WriteString("Result,Path,Target,Message\n"); err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		result, err := c.upload(item, state)
+		msg := ""
+		if err != nil {
+			msg = err.Error()
+		}
+		counts[result] += 1
+		line := fmt.Sprintf("%s,%s,%s,%s\n", result, csvQuote(item.Path), csvQuote(graphTarget(item)), csvQuote(msg))
+		if _, err := bw.WriteString(line); err != nil {
+			return err
+		}
+		// 中断した場合に備えて、1ファイルごとに書き出す
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	// 結果を出力
+	fmt.Println("◆SPOへのアップロード(OUTPUT_FILE_PATH)を完了しました。")
+	fmt.Printf("　→成功件数 : %d\n", counts[GraphUploadSuccess])
+	fmt.Printf("　→失敗件数 : %d\n", counts[GraphUploadFailure])
+	fmt.Printf("　→送信済み件数 : %d\n", counts[GraphUploadSkipped])
+
+	if counts[GraphUploadFailure] > 0 {
+		return fmt.Errorf("アップロードに失敗したファイルがあります。(%d 件)", counts[GraphUploadFailure])
+	}
+	return nil
+}
+
+// CSV の二重引用符の文字列に変換する。
+func csvQuote(s string) string {
+	return "\"" + strings.Replace(s, "\"", "\"\"", -1) + "\""
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Microsoft Graph のアップロードを模擬するサーバー
+type fakeGraphServer struct {
+	*httptest.Server
+	t *testing.T
+
+	mu        sync.Mutex
+	files     map[string][]byte      // 送信されたファイル(ドライブのルートからのパスごと)
+	sessions  map[string]*fakeUpload // アップロードセッション(ID ごと)
+	nextID    int
+	requests  []string // 受信したリクエスト(メソッド パス [Content-Range])
+	throttle  int      // 429 を返す残りの回数
+	failChunk int      // チャンクの PUT を 500 で失敗させる残りの回数
+	dropChunk int      // チャンクを受信した上で 503 を返す(応答の消失を模擬する)残りの回数
+	skipAfter int      // この回数のチャンクの PUT を受信した後、failChunk を適用する
+}
+
+// 送信中のアップロードセッション
+type fakeUpload struct {
+	target string
+	data   []byte
+}
+
+func newFakeGraphServer(t *testing.T) *fakeGraphServer {
+	s := &fakeGraphServer{t: t, files: make(map[string][]byte), sessions: make(map[string]*fakeUpload)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeGraphServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	req := r.Method + " " + r.URL.Path
+	if cr := r.Header.Get("Content-Range"); cr != "" {
+		req += " " + cr
+	}
+	s.requests = append(s.requests, req)
+
+	if s.throttle > 0 {
+		s.throttle--
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	const drivePrefix = "/drives/d1/root:/"
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/upload/"):
+		s.handleUpload(w, r, strings.TrimPrefix(r.URL.Path, "/upload/"), body)
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, drivePrefix) && strings.HasSuffix(r.URL.Path, ":/content"):
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		s.files["/"+strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, drivePrefix), ":/content")] = body
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id":"1"}`)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, drivePrefix) && strings.HasSuffix(r.URL.Path, ":/createUploadSession"):
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.sessions[id] = &fakeUpload{target: "/" + strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, drivePrefix), ":/createUploadSession")}
+		json.NewEncoder(w).Encode(map[string]string{"uploadUrl": s.URL + "/upload/" + id})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// アップロードセッションへのリクエストを処理する。
+func (s *fakeGraphServer) handleUpload(w http.ResponseWriter, r *http.Request, id string, body []byte) {
+	u, ok := s.sessions[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error":{"code":"itemNotFound","message":"session not found"}}`)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		json.NewEncoder(w).Encode(map[string][]string{"nextExpectedRanges": {fmt.Sprintf("%d-", len(u.data))}})
+		return
+	}
+
+	if s.skipAfter > 0 {
+		s.skipAfter--
+	} else if s.failChunk > 0 {
+		s.failChunk--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var start, end, total int
+	if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err != nil || end-start+1 != len(body) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if start != len(u.data) {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if len(body) > graphChunkSize || (end+1 < total && len(body)%graphChunkUnit != 0) {
+		s.t.Errorf("チャンクのサイズが不正です. %d", len(body))
+	}
+	u.data = append(u.data, body...)
+
+	if s.dropChunk > 0 {
+		s.dropChunk--
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if len(u.data) == total {
+		s.files[u.target] = u.data
+		delete(s.sessions, id)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id":"1"}`)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string][]string{"nextExpectedRanges": {fmt.Sprintf("%d-", len(u.data))}})
+}
+
+// 受信したリクエストのうち、prefix で始まるものを返す。
+func (s *fakeGraphServer) received(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []string
+	for _, r := range s.requests {
+		if strings.HasPrefix(r, prefix) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// size バイトのテスト用ファイルを dir に作成し、再送信対象ファイルを返す。
+func newGraphTestItem(t *testing.T, dir, name string, size int) (RecoveryItem, []byte) {
+	t.Helper()
+
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	p := filepath.ToSlash(filepath.Join(dir, name))
+	if err := os.WriteFile(p, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return RecoveryItem{Path: p, Folder: "/PJ/フォルダ #1", Size: size}, b
+}
+
+func newGraphTestClient(t *testing.T, s *fakeGraphServer, maxRetries int) *GraphClient {
+	t.Helper()
+
+	c, err := newGraphClient(s.URL+"/", "token", "d1", maxRetries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func newGraphTestState(t *testing.T, dir string) *GraphUploadState {
+	t.Helper()
+
+	state, err := loadGraphUploadState(filepath.Join(dir, "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestGraphUploadSmall(t *testing.T) {
+	s := newFakeGraphServer(t)
+	dir := t.TempDir()
+	item, data := newGraphTestItem(t, dir, "報告書 (最終).xlsx", graphSimpleUploadLimit)
+	state := newGraphTestState(t, dir)
+	c := newGraphTestClient(t, s, 0)
+
+	result, err := c.upload(item, state)
+	if err != nil || result != GraphUploadSuccess {
+		t.Fatalf("upload() = %s, %v", result, err)
+	}
+	if got := s.files["/PJ/フォルダ #1/報告書 (最終).xlsx"]; !bytes.Equal(got, data) {
+		t.Errorf("送信内容が一致しません. %d バイト", len(got))
+	}
+	if got := s.received("POST"); len(got) != 0 {
+		t.Errorf("4MiB 以下のファイルでアップロードセッションが作成されました. %v", got)
+	}
+
+	// 送信済みのファイルは送信しない
+	result, err = c.upload(item, state)
+	if err != nil || result != GraphUploadSkipped {
+		t.Errorf("upload() = %s, %v, want %s", result, err, GraphUploadSkipped)
+	}
+
+	// 更新日時が変更された場合は送信し直す
+	mtime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(item.Path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	result, err = c.upload(item, state)
+	if err != nil || result != GraphUploadSuccess {
+		t.Errorf("upload() = %s, %v, want %s", result, err, GraphUploadSuccess)
+	}
+}
+
+func TestGraphUploadSession(t *testing.T) {
+	s := newFakeGraphServer(t)
+	dir := t.TempDir()
+	size := 2*graphChunkSize + 1000
+	item, data := newGraphTestItem(t, dir, "large.bin", size)
+	state := newGraphTestState(t, dir)
+	c := newGraphTestClient(t, s, 0)
+
+	result, err := c.upload(item, state)
+	if err != nil || result != GraphUploadSuccess {
+		t.Fatalf("upload() = %s, %v", result, err)
+	}
+	if !bytes.Equal(s.files["/PJ/フォルダ #1/large.bin"], data) {
+		t.Errorf("送信内容が一致しません")
+	}
+
+	want := []string{
+		fmt.Sprintf("PUT /upload/1 bytes 0-%d/%d", graphChunkSize-1, size),
+		fmt.Sprintf("PUT /upload/1 bytes %d-%d/%d", graphChunkSize, 2*graphChunkSize-1, size),
+		fmt.Sprintf("PUT /upload/1 bytes %d-%d/%d", 2*graphChunkSize, size-1, size),
+	}
+	if got := s.received("PUT /upload/"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Content-Range = %v, want %v", got, want)
+	}
+}
+
+func TestGraphUploadRetryAfter(t *testing.T) {
+	s := newFakeGraphServer(t)
+	s.throttle = 2
+	dir := t.TempDir()
+	item, data := newGraphTestItem(t, dir, "a.txt", 100)
+	c := newGraphTestClient(t, s, 2)
+
+	result, err := c.upload(item, newGraphTestState(t, dir))
+	if err != nil || result != GraphUploadSuccess {
+		t.Fatalf("upload() = %s, %v", result, err)
+	}
+	if !bytes.Equal(s.files["/PJ/フォルダ #1/a.txt"], data) {
+		t.Errorf("送信内容が一致しません")
+	}
+	if got := len(s.received("PUT")); got != 3 {
+		t.Errorf("PUT の回数 = %d, want 3", got)
+	}
+
+	// 再試行の回数を超えた場合は失敗とする
+	s.throttle = 3
+	if result, err := c.upload(RecoveryItem{Path: item.Path, Folder: "/other"}, newGraphTestState(t, t.TempDir())); err == nil || result != GraphUploadFailure {
+		t.Errorf("upload() = %s, %v, want %s", result, err, GraphUploadFailure)
+	}
+}
+
+func TestGraphRetryAfter(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		min   time.Duration
+		max   time.Duration
+		ok    bool
+	}{
+		{"", 0, 0, false},
+		{"abc", 0, 0, false},
+		{"0", 0, 0, true},
+		{"120", 120 * time.Second, 120 * time.Second, true},
+		{time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat), 28 * time.Second, 30 * time.Second, true},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0, true},
+	} {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.value != "" {
+			resp.Header.Set("Retry-After", tt.value)
+		}
+		d, ok := graphRetryAfter(resp)
+		if ok != tt.ok || d < tt.min || d > tt.max {
+			t.Errorf("graphRetryAfter(%q) = %s, %t, want %s-%s, %t", tt.value, d, ok, tt.min, tt.max, tt.ok)
+		}
+	}
+}
+
+func TestGraphBackoff(t *testing.T) {
+	for _, tt := range []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{5, 32 * time.Second},
+		{6, graphMaxBackoff},
+		{34, graphMaxBackoff},
+		{100, graphMaxBackoff},
+	} {
+		if got := graphBackoff(tt.attempt); got != tt.want {
+			t.Errorf("graphBackoff(%d) = %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestGraphUploadResume(t *testing.T) {
+	s := newFakeGraphServer(t)
+	dir := t.TempDir()
+	size := 2*graphChunkSize + 1000
+	item, data := newGraphTestItem(t, dir, "large.bin", size)
+	state := newGraphTestState(t, dir)
+	c := newGraphTestClient(t, s, 0)
+
+	// 2つ目のチャンクで中断する
+	s.skipAfter, s.failChunk = 1, 1
+	if result, err := c.upload(item, state); err == nil || result != GraphUploadFailure {
+		t.Fatalf("upload() = %s, %v, want %s", result, err, GraphUploadFailure)
+	}
+
+	// 状態ファイルから、サーバーの受信済みの位置(nextExpectedRanges)を確認して再開する
+	state = newGraphTestState(t, dir)
+	e := state.Files[item.Path]
+	if e == nil || e.UploadURL != s.URL+"/upload/1" || e.Offset != graphChunkSize {
+		t.Fatalf("状態ファイル = %+v", e)
+	}
+	result, err := c.upload(item, state)
+	if err != nil || result != GraphUploadSuccess {
+		t.Fatalf("upload() = %s, %v", result, err)
+	}
+	if !bytes.Equal(s.files["/PJ/フォルダ #1/large.bin"], data) {
+		t.Errorf("送信内容が一致しません")
+	}
+	if got := s.received("GET /upload/1"); len(got) != 1 {
+		t.Errorf("nextExpectedRanges の問い合わせ = %v", got)
+	}
+	if got := s.received("PUT /upload/1 bytes 0-"); len(got) != 1 {
+		t.Errorf("先頭のチャンクを再送信しました. %v", got)
+	}
+}
+
+func TestGraphUploadRangeNotSatisfiable(t *testing.T) {
+	s := newFakeGraphServer(t)
+	dir := t.TempDir()
+	size := 2*graphChunkSize + 1000
+	item, data := newGraphTestItem(t, dir, "large.bin", size)
+	c := newGraphTestClient(t, s, 1)
+
+	// 受信済みのチャンクの応答が失われ、再試行で 416 となった場合は、受信済みの位置から送信し直す
+	s.dropChunk = 1
+	result, err := c.upload(item, newGraphTestState(t, dir))
+	if err != nil || result != GraphUploadSuccess {
+		t.Fatalf("upload() = %s, %v", result, err)
+	}
+	if !bytes.Equal(s.files["/PJ/フォルダ #1/large.bin"], data) {
+		t.Errorf("送信内容が一致しません")
+	}
+	if got := s.received("PUT /upload/1 bytes 0-"); len(got) != 2 {
+		t.Errorf("先頭のチャンクの送信 = %v, want 2回(再試行で 416)", got)
+	}
+	if got := s.received("GET /upload/1"); len(got) != 1 {
+		t.Errorf("nextExpectedRanges の問い合わせ = %v", got)
+	}
+}
+
+func TestGraphUploadExpiredSession(t *testing.T) {
+	s := newFakeGraphServer(t)
+	dir := t.TempDir()
+	size := graphChunkSize + 1000
+	item, data := newGraphTestItem(t, dir, "large.bin", size)
+	state := newGraphTestState(t, dir)
+	c := newGraphTestClient(t, s, 0)
+
+	// 失効した(404 となる)アップロードセッションの状態
+	info, err := os.Stat(item.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Files[item.Path] = &GraphUploadEntry{Target: graphTarget(item), Size: int64(size), Mtime: info.ModTime(), UploadURL: s.URL + "/upload/expired", Offset: graphChunkSize}
+
+	result, err := c.upload(item, state)
+	if err != nil || result != GraphUploadSuccess {
+		t.Fatalf("upload() = %s, %v", result, err)
+	}
+	if !bytes.Equal(s.files["/PJ/フォルダ #1/large.bin"], data) {
+		t.Errorf("送信内容が一致しません")
+	}
+	if got := s.received("POST"); len(got) != 1 {
+		t.Errorf("アップロードセッションの作成 = %v", got)
+	}
+	if got := s.received("PUT /upload/1 bytes 0-"); len(got) != 1 {
+		t.Errorf("新しいセッションで先頭から送信していません. %v", s.received("PUT"))
+	}
+}
+
+func TestExecuteGraphUploadsFailure(t *testing.T) {
+	s := newFakeGraphServer(t)
+	dir := t.TempDir()
+	item, _ := newGraphTestItem(t, dir, "a.txt", 100)
+	missing := RecoveryItem{Path: filepath.ToSlash(filepath.Join(dir, "missing.txt")), Folder: "/PJ"}
+	c := newGraphTestClient(t, s, 0)
+
+	var buf bytes.Buffer
+	err := executeGraphUploads(c, []RecoveryItem{item, missing}, newGraphTestState(t, dir), &buf)
+	if err == nil {
+		t.Errorf("送信に失敗したファイルがある場合にエラーになりません")
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], GraphUploadSuccess+",") || !strings.HasPrefix(lines[2], GraphUploadFailure+",") {
+		t.Errorf("結果ファイル = %q", buf.String())
+	}
+}
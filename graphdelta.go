@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// 差分クエリで取得する driveItem のプロパティ
+const graphDeltaSelect = "id,name,parentReference,size,lastModifiedDateTime,file,folder,root,deleted"
+
+// 差分クエリで取得した driveItem
+type graphDriveItem struct {
+	ID                   string    `json:"id"`
+	Name                 string    `json:"name"`
+	Size                 int       `json:"size"`
+	LastModifiedDateTime time.Time `json:"lastModifiedDateTime"`
+	ParentReference      struct {
+		ID string `json:"id"`
+	} `json:"parentReference"`
+	File *struct {
+		Hashes struct {
+			QuickXorHash string `json:"quickXorHash"`
+		} `json:"hashes"`
+	} `json:"file"`
+	Folder  *struct{} `json:"folder"`
+	Root    *struct{} `json:"root"`
+	Deleted *struct{} `json:"deleted"`
+}
+
+// 差分クエリの1ページ
+type graphDeltaPage struct {
+	Value     []graphDriveItem `json:"value"`
+	NextLink  string           `json:"@odata.nextLink"`
+	DeltaLink string           `json:"@odata.deltaLink"`
+}
+
+// 状態ファイルに保存する driveItem
+type GraphDeltaItem struct {
+	Name     string    `json:"name"`
+	ParentID string    `json:"parentId,omitempty"`
+	Size     int       `json:"size"`
+	Mtime    time.Time `json:"mtime"`
+	Hash     string    `json:"hash,omitempty"`   // quickXorHash
+	Folder   bool      `json:"folder,omitempty"` // フォルダの場合 true
+	Root     bool      `json:"root,omitempty"`   // ドライブのルートの場合 true
+}
+
+// 差分クエリの状態ファイル
+type GraphDeltaState struct {
+	path      string
+	DeltaLink string                     `json:"deltaLink"` // 次回の差分クエリの URL
+	Items     map[string]*GraphDeltaItem `json:"items"`     // driveItem の ID ごとのアイテム
+}
+
+// path で指定された状態ファイルを読み込む。ファイルが存在しない場合は空の状態とする。
+func loadGraphDeltaState(path string) (*GraphDeltaState, error) {
+	s := &GraphDeltaState{path: path, Items: make(map[string]*GraphDeltaItem)}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("状態ファイルのフォーマット不正. %s", err)
+	}
+	if s.Items == nil {
+		s.Items = make(map[string]*GraphDeltaItem)
+	}
+	return s, nil
+}
+
+// 状態ファイルを保存する。書き込み途中で中断しても壊れないように、一時ファイルに書き込んでから置き換える。
+func (s *GraphDeltaState) save() error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// 差分の driveItem を状態に反映する。
+func (s *GraphDeltaState) apply(item graphDriveItem) {
+	if item.Deleted != nil {
+		delete(s.Items, item.ID)
+		return
+	}
+	v := &GraphDeltaItem{
+		Name:     item.Name,
+		ParentID: item.ParentReference.ID,
+		Size:     item.Size,
+		Mtime:    item.LastModifiedDateTime,
+		Folder:   item.Folder != nil,
+		Root:     item.Root != nil,
+	}
+	if item.File != nil {
+		v.Hash = item.File.Hashes.QuickXorHash
+	}
+	s.Items[item.ID] = v
+}
+
+// ID が id のアイテムの、ドライブのルートからのパス(先頭の「/」なし)を返す。
+// 親フォルダをたどってルートに到達できない場合は false を返す。
+func (s *GraphDeltaState) itemPath(id string, cache map[string]string) (string, bool) {
+	if p, ok := cache[id]; ok {
+		return p, true
+	}
+
+	var names []string
+	for cur, depth := id, 0; ; depth++ {
+		item, ok := s.Items[cur]
+		// 親フォルダの循環に備えて、深さを制限する
+		if !ok || depth > len(s.Items) {
+			return "", false
+		}
+		if item.Root {
+			break
+		}
+		names = append(names, item.Name)
+		cur = item.ParentID
+	}
+
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	p := strings.Join(names, "/")
+	cache[id] = p
+	return p, true
+}
+
+// ドライブの差分クエリを実行し、状態 s を更新する。変更されたアイテムの件数を返す。
+// 状態に差分クエリの URL がない場合、または URL が失効している(410 Gone)場合は、すべてのアイテムを取得し直す。
+func (c *GraphClient) refreshDelta(s *GraphDeltaState) (uint, error) {
+	var changed uint
+
+	next := s.DeltaLink
+	if next == "" {
+		next = fmt.Sprintf("%s/drives/%s/root/delta?$select=%s", c.endpoint, url.PathEscape(c.driveID), graphDeltaSelect)
+		s.Items = make(map[string]*GraphDeltaItem)
+	}
+
+	for next != "" {
+		u := next
+		resp, err := c.do(func() (*http.Request, error) {
+			return c.newRequest(http.MethodGet, u, nil, "")
+		})
+		if err != nil {
+			return changed, err
+		}
+
+		if resp.StatusCode == http.StatusGone && s.DeltaLink != "" {
+			resp.Body.Close()
+			fmt.Println("◆差分クエリの URL が失効しているため、すべてのファイルを取得し直します。")
+			s.DeltaLink = ""
+			return c.refreshDelta(s)
+		}
+
+		var page graphDeltaPage
+		if err := decodeGraphResponse(resp, &page); err != nil {
+			return changed, err
+		}
+		for _, item := range page.Value {
+			s.apply(item)
+			changed += 1
+		}
+
+		next = page.NextLink
+		if page.DeltaLink != "" {
+			s.DeltaLink = page.DeltaLink
+		}
+	}
+
+	return changed, nil
+}
+
+// ドライブのルートからのパス itemPath の、フォルダ sd(前後の「/」なし)からの相対パスを返す。大文字小文字は区別しない。
+// 「PJ」に対する「PJ2/a.txt」のように、sd 配下でない場合は false を返す。
+func graphRelativePath(itemPath, sd string) (string, bool) {
+	if sd == "" {
+		return itemPath, true
+	}
+	if len(itemPath) <= len(sd) || itemPath[len(sd)] != '/' || !strings.EqualFold(itemPath[:len(sd)], sd) {
+		return "", false
+	}
+	return itemPath[len(sd)+1:], true
+}
+
+// Microsoft Graph の差分クエリでライブラリのファイルを取得し、チェック先ファイルのマップを生成する。
+// 差分クエリの状態は statePath に保存し、次回は前回からの差分のみを取得する。
+// ファイルパスは、ドライブのルートからのパスの先頭から sd を除き、先頭に prifix を付加したパスとする。
+// sd は、パスの区切り(「/」)の単位で比較し、sd 配下でないファイルはスキップする。
+// 更新日時は、SPO のファイルリストと同様に9時間加算する。
+func generateDestMapFromGraph(c *GraphClient, statePath, prifix, sd string) (map[string]History, error) {
+	m := make(map[string]History)
+	var read, skip, add uint
+
+	s, err := loadGraphDeltaState(statePath)
+	if err != nil {
+		return nil, err
+	}
+	changed, err := c.refreshDelta(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+
+	p := modifySourcePathPrifix(prifix)
+	sd = strings.Trim(sd, "/")
+
+	cache := make(map[string]string)
+	for id, item := range s.Items {
+		read += 1
+
+		// フォルダはチェック対象外のためスキップする
+		if item.Folder || item.Root {
+			skip += 1
+			continue
+		}
+
+		itemPath, ok := s.itemPath(id, cache)
+		if !ok {
+			skip += 1
+			continue
+		}
+		rel, ok := graphRelativePath(itemPath, sd)
+		if !ok {
+			skip += 1
+			continue
+		}
+		path := p + rel
+
+		d := item.Mtime.UTC().Add(9 * time.Hour) // 9時間加算
+
+		// SPOへアップロードすると大文字に（勝手に）変換される場合があるので、キーは小文字に変換する
+		m[strings.ToLower(path)] = History{&SizeAndDateModified{item.Size, d, item.Hash, path}}
+
+		add += 1
+	}
+
+	// ファイル読み込み結果を出力
+	fmt.Println("◆チェック先ファイル(GRAPH_STATE_FILE_PATH)の取得を完了しました。")
+	fmt.Printf("　→差分件数 : %d\n", changed)
+	fmt.Printf("　→読み込み件数 : %d\n", read)
+	fmt.Printf("　→検索用ファイル件数 : %d\n", add)
+	fmt.Printf("　→スキップ件数: %d\n", skip)
+
+	return m, nil
+}
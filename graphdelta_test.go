@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Microsoft Graph の差分クエリを模擬するサーバー
+type fakeDeltaServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []string // 受信したリクエストのパス
+}
+
+// すべてのアイテムを取得する差分クエリの応答(2ページ)
+// PJ2 配下のファイルは、SPO_DIR(PJ)の前方一致では一致するが、フォルダとしては配下でない。
+const fakeDeltaFullPage1 = `{"value":[
+{"id":"root","name":"root","root":{},"folder":{}},
+{"id":"f1","name":"PJ","parentReference":{"id":"root"},"folder":{}},
+{"id":"i1","name":"報告書.xlsx","parentReference":{"id":"f1"},"size":10,"lastModifiedDateTime":"2026-10-18T01:02:03Z","file":{"hashes":{"quickXorHash":"AAAA"}}}
+],"@odata.nextLink":"%s/delta/page2"}`
+
+const fakeDeltaFullPage2 = `{"value":[
+{"id":"f2","name":"Sub #1","parentReference":{"id":"f1"},"folder":{}},
+{"id":"i2","name":"b.txt","parentReference":{"id":"f2"},"size":20,"lastModifiedDateTime":"2026-10-18T15:00:00Z","file":{"hashes":{"quickXorHash":"BBBB"}}},
+{"id":"f3","name":"PJ2","parentReference":{"id":"root"},"folder":{}},
+{"id":"i3","name":"x.txt","parentReference":{"id":"f3"},"size":30,"lastModifiedDateTime":"2026-10-18T00:00:00Z","file":{"hashes":{"quickXorHash":"CCCC"}}}
+],"@odata.deltaLink":"%s/delta/token1"}`
+
+// 前回からの差分(i1 の名前の変更と、i2 の削除)
+const fakeDeltaChanges = `{"value":[
+{"id":"i1","name":"報告書(改).xlsx","parentReference":{"id":"f1"},"size":11,"lastModifiedDateTime":"2026-10-19T01:02:03Z","file":{"hashes":{"quickXorHash":"DDDD"}}},
+{"id":"i2","deleted":{}}
+],"@odata.deltaLink":"%s/delta/token2"}`
+
+func newFakeDeltaServer(t *testing.T) *fakeDeltaServer {
+	s := &fakeDeltaServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeDeltaServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.URL.Path)
+	s.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/drives/d1/root/delta":
+		if !strings.Contains(r.URL.Query().Get("$select"), "parentReference") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, fakeDeltaFullPage1, s.URL)
+	case "/delta/page2":
+		fmt.Fprintf(w, fakeDeltaFullPage2, s.URL)
+	case "/delta/token1":
+		fmt.Fprintf(w, fakeDeltaChanges, s.URL)
+	case "/delta/token2":
+		fmt.Fprintf(w, `{"value":[],"@odata.deltaLink":"%s/delta/token2"}`, s.URL)
+	case "/delta/expired":
+		w.WriteHeader(http.StatusGone)
+		fmt.Fprint(w, `{"error":{"code":"resyncRequired","message":"resync required"}}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// 受信したリクエストのパスを返し、記録を消去する。
+func (s *fakeDeltaServer) take() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := s.requests
+	s.requests = nil
+	return out
+}
+
+// チェック先ファイルのマップを「パス,サイズ,更新日時,ハッシュ」の形式で比較できるようにする。
+func destMapLines(m map[string]History) map[string]string {
+	out := make(map[string]string)
+	for k, h := range m {
+		v := h.Latest()
+		out[k] = fmt.Sprintf("%s,%d,%s,%s", v.Path, v.Size, v.DateModified.Format("2006/01/02 15:04:05"), v.Hash)
+	}
+	return out
+}
+
+func assertDestMap(t *testing.T, got map[string]History, want map[string]string) {
+	t.Helper()
+
+	lines := destMapLines(got)
+	if len(lines) != len(want) {
+		t.Errorf("件数 = %d, want %d. %v", len(lines), len(want), lines)
+	}
+	for k, v := range want {
+		if lines[k] != v {
+			t.Errorf("destMap[%q] = %q, want %q", k, lines[k], v)
+		}
+	}
+}
+
+func TestGenerateDestMapFromGraph(t *testing.T) {
+	s := newFakeDeltaServer(t)
+	c, err := newGraphClient(s.URL, "token", "d1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statePath := filepath.Join(t.TempDir(), "delta.json")
+
+	// 初回は、すべてのページを取得する
+	m, err := generateDestMapFromGraph(c, statePath, "C:\\base", "/PJ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(s.take(), " "); got != "/drives/d1/root/delta /delta/page2" {
+		t.Errorf("リクエスト = %s", got)
+	}
+	// 更新日時は9時間加算し、キーは小文字とする。PJ2 配下のファイルは含めない
+	assertDestMap(t, m, map[string]string{
+		"c:/base/報告書.xlsx":     "C:/base/報告書.xlsx,10,2026/10/18 10:02:03,AAAA",
+		"c:/base/sub #1/b.txt": "C:/base/Sub #1/b.txt,20,2026/10/19 00:00:00,BBBB",
+	})
+
+	state, err := loadGraphDeltaState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.DeltaLink != s.URL+"/delta/token1" || len(state.Items) != 7 {
+		t.Errorf("状態ファイル deltaLink=%s, items=%d", state.DeltaLink, len(state.Items))
+	}
+
+	// 2回目は、保存した deltaLink から差分のみを取得する
+	m, err = generateDestMapFromGraph(c, statePath, "C:/base/", "PJ/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(s.take(), " "); got != "/delta/token1" {
+		t.Errorf("リクエスト = %s", got)
+	}
+	assertDestMap(t, m, map[string]string{
+		"c:/base/報告書(改).xlsx": "C:/base/報告書(改).xlsx,11,2026/10/19 10:02:03,DDDD",
+	})
+
+	// SPO_DIR を指定しない場合は、ドライブのルートからのパスとする
+	m, err = generateDestMapFromGraph(c, statePath, "C:/base", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertDestMap(t, m, map[string]string{
+		"c:/base/pj/報告書(改).xlsx": "C:/base/PJ/報告書(改).xlsx,11,2026/10/19 10:02:03,DDDD",
+		"c:/base/pj2/x.txt":      "C:/base/PJ2/x.txt,30,2026/10/18 09:00:00,CCCC",
+	})
+}
+
+func TestRefreshDeltaResync(t *testing.T) {
+	s := newFakeDeltaServer(t)
+	c, err := newGraphClient(s.URL, "token", "d1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// deltaLink が失効している場合(410 Gone)は、すべてのアイテムを取得し直す
+	state := &GraphDeltaState{
+		path:      filepath.Join(t.TempDir(), "delta.json"),
+		DeltaLink: s.URL + "/delta/expired",
+		Items: map[string]*GraphDeltaItem{
+			"root":  {Name: "root", Root: true, Folder: true},
+			"stale": {Name: "stale.txt", ParentID: "root", Size: 1, Mtime: time.Now()},
+		},
+	}
+	changed, err := c.refreshDelta(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(s.take(), " "); got != "/delta/expired /drives/d1/root/delta /delta/page2" {
+		t.Errorf("リクエスト = %s", got)
+	}
+	if changed != 7 {
+		t.Errorf("差分件数 = %d, want 7", changed)
+	}
+	if _, ok := state.Items["stale"]; ok {
+		t.Errorf("取得し直す前のアイテムが残っています")
+	}
+	if state.DeltaLink != s.URL+"/delta/token1" {
+		t.Errorf("deltaLink = %s", state.DeltaLink)
+	}
+}
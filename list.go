@@ -0,0 +1,636 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/saracen/walker"
+)
+
+// list コマンドで追加出力できる列
+const (
+	listColumnExt     = "ext"      // 拡張子(3列目に出力する)
+	listColumnMtimeNs = "mtime-ns" // 更新日時(ナノ秒)
+	listColumnCtime   = "ctime"    // ctime(Windowsの場合は作成日時)
+	listColumnInode   = "inode"    // デバイス番号,inode番号
+	listColumnMode    = "mode"     // モード
+	listColumnOwner   = "owner"    // uid,gid,所有者,グループ
+	listColumnSymlink = "symlink"  // シンボリックリンクのリンク先
+	listColumnNlink   = "nlink"    // ハードリンク数
+)
+
+var listColumns = map[string]bool{
+	listColumnExt:     true,
+	listColumnMtimeNs: true,
+	listColumnCtime:   true,
+	listColumnInode:   true,
+	listColumnMode:    true,
+	listColumnOwner:   true,
+	listColumnSymlink: true,
+	listColumnNlink:   true,
+}
+
+// ナノ秒までの日時のフォーマット
+const listTimeFormatNs = "2006/01/02 15:04:05.000000000"
+
+// ファイルリストの出力内容
+type listOptions struct {
+	hashFunc func(r io.Reader) (string, error) // ハッシュ値を計算する関数。nil の場合は計算しない
+	ext      bool                              // 拡張子を出力する場合 true
+	columns  []string                          // 8列目(ハッシュ値)以降に出力する列
+}
+
+// ハッシュ値のアルゴリズム hashAlg と、カンマ区切りの追加列 columns から出力内容を生成する。
+func newListOptions(hashAlg, columns string) (*listOptions, error) {
+	o := &listOptions{}
+
+	if hashAlg != "" {
+		hashFunc, err := newHashFunc(hashAlg)
+		if err != nil {
+			return nil, err
+		}
+		o.hashFunc = hashFunc
+	}
+
+	for _, c := range strings.Split(columns, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !listColumns[c] {
+			return nil, fmt.Errorf("出力する列の指定が不正です. COLUMNS=%s", c)
+		}
+		if c == listColumnExt {
+			o.ext = true
+			continue
+		}
+		o.columns = append(o.columns, c)
+	}
+
+	return o, nil
+}
+
+// path のファイル情報 info から、ファイルリストの1行を生成する。
+// 1行の構成は次の通り。ハッシュ値と追加列を出力しない場合は、先頭の7列のみとなる。
+// "ファイル名","ファイルのフルパス","ファイルの拡張子",ファイルサイズ,フォルダフラグ(フォルダの場合TRUE),更新日,更新時刻[,"ハッシュ値"[,追加列...]]
+func (o *listOptions) line(path string, info os.FileInfo) (string, error) {
+	filename := info.Name() // ファイル名
+	ext := ""               // ファイルの拡張子
+	if o.ext && !info.IsDir() {
+		ext = strings.TrimLeft(filepath.Ext(filename), ".")
+	}
+	size := info.Size() // ファイルサイズ
+	folderFlag := "FALSE"
+	if info.IsDir() {
+		folderFlag = "TRUE"
+	}
+	updateDate := info.ModTime().Format("2006/01/02") // 更新日
+	updateTime := info.ModTime().Format("15:04:05")   // 更新時刻
+
+	// "ファイル名","ファイルのフルパス","ファイルの拡張子",ファイルサイズ,フォルダフラグ(フォルダの場合TRUE),更新日,更新時刻
+	s := fmt.Sprintf("\"%s\",\"%s\",\"%s\",%d,%s,%s,%s", filename, path, ext, size, folderFlag, updateDate, updateTime)
+
+	if o.hashFunc == nil && len(o.columns) == 0 {
+		return s, nil
+	}
+
+	// ,"ハッシュ値"
+	// 追加列を出力する場合、ハッシュ値を計算しないときも列の位置を揃えるため空の列を出力する
+	h := ""
+	if o.hashFunc != nil && info.Mode().IsRegular() {
+		var err error
+		if ai, ok := info.(*archiveFileInfo); ok {
+			h, err = ai.hash(o.hashFunc)
+		} else {
+			h, err = hashFile(path, o.hashFunc)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	s += fmt.Sprintf(",\"%s\"", h)
+
+	// ,追加列...
+	sys := getSysFileInfo(info)
+	for _, c := range o.columns {
+		switch c {
+		case listColumnMtimeNs:
+			s += "," + info.ModTime().Format(listTimeFormatNs)
+		case listColumnCtime:
+			s += "," + formatTimeNs(sys.ctime)
+		case listColumnInode:
+			s += "," + formatSysID(sys.hasID, sys.dev) + "," + formatSysID(sys.hasID, sys.ino)
+		case listColumnMode:
+			s += "," + info.Mode().String()
+		case listColumnOwner:
+			if sys.hasOwner {
+				s += fmt.Sprintf(",%s,%s,\"%s\",\"%s\"", sys.uid, sys.gid, lookupUserName(sys.uid), lookupGroupName(sys.gid))
+			} else {
+				s += ",,,\"\",\"\""
+			}
+		case listColumnSymlink:
+			target := ""
+			if ai, ok := info.(*archiveFileInfo); ok {
+				target = ai.linkname
+			} else if info.Mode()&os.ModeSymlink != 0 {
+				target, _ = os.Readlink(path)
+			}
+			s += fmt.Sprintf(",\"%s\"", target)
+		case listColumnNlink:
+			s += "," + formatSysID(sys.hasID, sys.nlink)
+		}
+	}
+
+	return s, nil
+}
+
+func formatTimeNs(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(listTimeFormatNs)
+}
+
+func formatSysID(ok bool, v uint64) string {
+	if !ok {
+		return ""
+	}
+	return strconv.FormatUint(v, 10)
+}
+
+// uid, gid から名前への変換結果のキャッシュ(ワーカーから並行して参照される)
+var userNames, groupNames sync.Map
+
+// uid から所有者の名前を取得する。取得できない場合は空文字を返す。
+func lookupUserName(uid string) string {
+	if v, ok := userNames.Load(uid); ok {
+		return v.(string)
+	}
+	name := ""
+	if u, err := user.LookupId(uid); err == nil {
+		name = u.Username
+	}
+	userNames.Store(uid, name)
+	return name
+}
+
+// gid からグループの名前を取得する。取得できない場合は空文字を返す。
+func lookupGroupName(gid string) string {
+	if v, ok := groupNames.Load(gid); ok {
+		return v.(string)
+	}
+	name := ""
+	if g, err := user.LookupGroupId(gid); err == nil {
+		name = g.Name
+	}
+	groupNames.Store(gid, name)
+	return name
+}
+
+// ファイルリスト作成時に読み込めなかったパスを記録する(ワーカーから並行して呼び出される)
+type walkErrorRecorder struct {
+	mu     sync.Mutex
+	fp     *os.File
+	bw     *bufio.Writer
+	count  uint
+	closed bool
+}
+
+// outfile で指定されたファイルに記録する。既にファイルが存在する場合は削除
+// 再開する場合は cp の時点の位置から記録する。
+func newWalkErrorRecorder(outfile string, cp *checkpoint) (*walkErrorRecorder, error) {
+	fp, err := openResumableFile(outfile, cp.resumed, cp.errorsOffset)
+	if err != nil {
+		return nil, err
+	}
+	return &walkErrorRecorder{fp: fp, bw: bufio.NewWriter(fp), count: cp.errorsCount}, nil
+}
+
+// 記録済みの内容を書き出し、エラーファイルのサイズと記録件数を返す。
+func (r *walkErrorRecorder) flush() (int64, uint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.bw.Flush(); err != nil {
+		return 0, 0, err
+	}
+	offset, err := r.fp.Seek(0, io.SeekCurrent)
+	return offset, r.count, err
+}
+
+// 読み込めなかったパス path とエラー err を記録する。
+// 1行の構成は次の通り。errno を取得できない場合は空とする。
+// "パス",errno,"エラーメッセージ"
+func (r *walkErrorRecorder) record(path string, err error) error {
+	errno := ""
+	var e syscall.Errno
+	if errors.As(err, &e) {
+		errno = strconv.Itoa(int(e))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.count += 1
+	_, werr := r.bw.WriteString(fmt.Sprintf("\"%s\",%s,\"%s\"\n", path, errno, strings.Replace(err.Error(), "\"", "'", -1)))
+	return werr
+}
+
+// 記録済みの内容を書き出し、エラーファイルを閉じる。複数回呼び出した場合、2回目以降は何もしない。
+func (r *walkErrorRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	if err := r.bw.Flush(); err != nil {
+		r.fp.Close()
+		return err
+	}
+	return r.fp.Close()
+}
+
+// ファイルリスト作成時の探索条件
+type walkOptions struct {
+	excludes       []string           // 探索しないフォルダ名のパターン
+	maxDepth       int                // 探索する階層の深さ。0 の場合は無制限
+	oneFileSystem  bool               // 異なるファイルシステムのフォルダを探索しない場合 true
+	followSymlinks bool               // シンボリックリンクのリンク先を探索する場合 true
+	recorder       *walkErrorRecorder // 読み込めなかったパスを記録する場合に指定する
+	throttle       *walkThrottle      // 探索の負荷を制限する場合に指定する
+}
+
+// フォルダ名 name が除外パターンに一致する場合 true を返す。大文字小文字は区別しない。
+func (o *walkOptions) excluded(name string) bool {
+	name = strings.ToLower(name)
+	for _, p := range o.excludes {
+		if ok, _ := filepath.Match(strings.ToLower(p), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// エラーを記録する場合は記録して処理を継続し、それ以外の場合はエラーを返して処理を中断する。
+func (o *walkOptions) handleError(path string, err error) error {
+	if o.recorder != nil {
+		return o.recorder.record(path, err)
+	}
+	return err
+}
+
+// root 配下のファイルとフォルダごとに fn を呼び出す(root 自身は含まない)。
+// fn は複数のゴルーチンから並行して呼び出される。
+// 除外、階層の深さ、ファイルシステムの条件に該当するフォルダは、配下を探索しない。
+func walkTree(root string, opts *walkOptions, fn func(path string, info os.FileInfo) error) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return opts.handleError(root, err)
+	}
+	return walkSubtree(root, root, 0, getSysFileInfo(info), nil, opts, fn)
+}
+
+// dir 配下を探索し、パスの先頭の dir を base に置き換えて fn を呼び出す。
+// base はシンボリックリンクをたどった場合のリンクのパスで、depth は base の階層の深さ。
+func walkSubtree(dir, base string, depth int, rootSys sysFileInfo, chain *symlinkChain, opts *walkOptions, fn func(path string, info os.FileInfo) error) error {
+	var errorCallback func(pathname string, err error) error
+	if opts.recorder != nil {
+		errorCallback = func(pathname string, err error) error {
+			return opts.recorder.record(base+strings.TrimPrefix(pathname, dir), err)
+		}
+	}
+
+	walkFn := func(p string, info os.FileInfo) error {
+		if p == dir {
+			return nil
+		}
+		path := base + strings.TrimPrefix(p, dir)
+		d := depth + strings.Count(strings.Trim(strings.TrimPrefix(p, dir), string(filepath.Separator)), string(filepath.Separator)) + 1
+
+		opts.throttle.wait()
+		return visitEntry(p, path, d, info, rootSys, chain, opts, fn)
+	}
+
+	// 並行して探索する数を指定した場合は、walker の代わりに上限付きで探索する
+	if opts.throttle != nil && opts.throttle.concurrent > 0 {
+		return walkLimited(dir, opts.throttle.concurrent, &opts.throttle.running, walkFn, errorCallback)
+	}
+
+	var walkOpts []walker.Option
+	if errorCallback != nil {
+		walkOpts = append(walkOpts, walker.WithErrorCallback(errorCallback))
+	}
+	return walker.Walk(dir, walkFn, walkOpts...)
+}
+
+// p のファイル情報 info を、パス path として fn に渡す。
+// 配下を探索しないフォルダの場合は filepath.SkipDir を返す。
+func visitEntry(p, path string, depth int, info os.FileInfo, rootSys sysFileInfo, chain *symlinkChain, opts *walkOptions, fn func(path string, info os.FileInfo) error) error {
+	// シンボリックリンクをたどる場合は、リンク先の情報を出力する
+	if opts.followSymlinks && info.Mode()&os.ModeSymlink != 0 {
+		return walkSymlink(p, path, depth, rootSys, chain, opts, fn)
+	}
+
+	if !info.IsDir() {
+		return fn(path, info)
+	}
+
+	// 除外するフォルダは出力も探索もしない
+	if opts.excluded(info.Name()) {
+		return filepath.SkipDir
+	}
+
+	if err := fn(path, info); err != nil {
+		return err
+	}
+
+	// 異なるファイルシステムのフォルダ(マウントポイント)は探索しない
+	if opts.oneFileSystem && rootSys.hasID {
+		if sys := getSysFileInfo(info); sys.hasID && sys.dev != rootSys.dev {
+			return filepath.SkipDir
+		}
+	}
+
+	// 指定した深さより深い階層は探索しない
+	if opts.maxDepth > 0 && depth >= opts.maxDepth {
+		return filepath.SkipDir
+	}
+
+	return nil
+}
+
+// root 直下のエントリごとに、名前の昇順で探索する(root 自身は含まない)。
+// 直下のファイルは、まとめて1つのエントリ(checkpointFiles)として最初に探索する。
+// skip が true を返すエントリは探索せず、エントリの探索が完了するたびに entryDone を呼び出す。
+func walkTreeByEntry(root string, opts *walkOptions, fn func(path string, info os.FileInfo) error, skip func(name string) bool, entryDone func(name string) error) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return opts.handleError(root, err)
+	}
+	rootSys := getSysFileInfo(info)
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return opts.handleError(root, err)
+	}
+
+	// 直下のファイル
+	if !skip(checkpointFiles) {
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			if err := visitRootEntry(root, e, rootSys, opts, fn); err != nil {
+				return err
+			}
+		}
+		if err := entryDone(checkpointFiles); err != nil {
+			return err
+		}
+	}
+
+	// 直下のフォルダ
+	for _, e := range entries {
+		if !e.IsDir() || skip(e.Name()) {
+			continue
+		}
+		if err := visitRootEntry(root, e, rootSys, opts, fn); err != nil {
+			return err
+		}
+		if err := entryDone(e.Name()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// root 直下のエントリ e を探索する。
+func visitRootEntry(root string, e os.DirEntry, rootSys sysFileInfo, opts *walkOptions, fn func(path string, info os.FileInfo) error) error {
+	// walker と同じく、区切り文字で連結したパスとする
+	p := root + string(filepath.Separator) + e.Name()
+	opts.throttle.wait()
+	info, err := e.Info()
+	if err != nil {
+		return opts.handleError(p, err)
+	}
+
+	err = visitEntry(p, p, 1, info, rootSys, nil, opts, fn)
+	if err == filepath.SkipDir {
+		return nil
+	}
+	if err != nil || !info.IsDir() {
+		return err
+	}
+	return walkSubtree(p, p, 1, rootSys, nil, opts, fn)
+}
+
+// 探索中にたどったシンボリックリンクのリンク先(フォルダ)の連鎖
+type symlinkChain struct {
+	target string // リンク先のシンボリックリンクを解決した絶対パス
+	parent *symlinkChain
+}
+
+// リンク先 target を、既にたどった場合 true を返す。
+func (c *symlinkChain) contains(target string) bool {
+	for ; c != nil; c = c.parent {
+		if c.target == target {
+			return true
+		}
+	}
+	return false
+}
+
+// シンボリックリンク p のリンク先を、リンクのパス path として出力する。
+// リンク先がフォルダの場合は配下も探索する。
+// リンク先がリンクの祖先の場合、またはリンク先を chain で既にたどっている場合(a/toB → b, b/toA → a など)は、
+// 循環するため探索しない。
+func walkSymlink(p, path string, depth int, rootSys sysFileInfo, chain *symlinkChain, opts *walkOptions, fn func(path string, info os.FileInfo) error) error {
+	target, err := evalSymlinksAbs(p)
+	if err != nil {
+		return opts.handleError(path, err)
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return opts.handleError(path, err)
+	}
+
+	if !info.IsDir() {
+		return fn(path, info)
+	}
+
+	if opts.excluded(filepath.Base(path)) {
+		return nil
+	}
+
+	parent, err := evalSymlinksAbs(filepath.Dir(p))
+	if err != nil {
+		return opts.handleError(path, err)
+	}
+	if parent == target || strings.HasPrefix(parent, target+string(filepath.Separator)) || chain.contains(target) {
+		return opts.handleError(path, fmt.Errorf("シンボリックリンクが循環しています. target=%s", target))
+	}
+
+	if err := fn(path, info); err != nil {
+		return err
+	}
+
+	if opts.oneFileSystem && rootSys.hasID {
+		if sys := getSysFileInfo(info); sys.hasID && sys.dev != rootSys.dev {
+			return nil
+		}
+	}
+	if opts.maxDepth > 0 && depth >= opts.maxDepth {
+		return nil
+	}
+
+	return walkSubtree(target, path, depth, rootSys, &symlinkChain{target, chain}, opts, fn)
+}
+
+// p のシンボリックリンクをすべて解決した絶対パスを返す。
+func evalSymlinksAbs(p string) (string, error) {
+	s, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(s)
+}
+
+// 直下のファイルを表すチェックポイントのエントリ名
+const checkpointFiles = "."
+
+// ファイルリスト作成の途中経過
+// チェックポイントファイルの1行は次の構成で、エントリの探索が完了するたびに追記する。
+// BASE_DIR<TAB>エントリ名<TAB>ファイルリストのサイズ<TAB>エラーファイルのサイズ<TAB>エラー件数
+type checkpoint struct {
+	resumed      bool            // チェックポイントから再開する場合 true
+	done         map[string]bool // 探索が完了した "BASE_DIR<TAB>エントリ名"
+	listOffset   int64           // 最後に完了した時点のファイルリストのサイズ
+	errorsOffset int64           // 最後に完了した時点のエラーファイルのサイズ
+	errorsCount  uint            // 最後に完了した時点のエラー件数
+}
+
+func checkpointKey(root, name string) string {
+	return root + "\t" + name
+}
+
+// path で指定されたチェックポイントファイルを読み込む。ファイルが存在しない場合は最初から探索する。
+func loadCheckpoint(path string) (*checkpoint, error) {
+	cp := &checkpoint{resumed: true, done: make(map[string]bool)}
+
+	fp, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	s := bufio.NewScanner(fp)
+	for s.Scan() {
+		ary := strings.Split(s.Text(), "\t")
+		if len(ary) != 5 {
+			// 書き込み途中で中断した行は無視する
+			continue
+		}
+		listOffset, err1 := strconv.ParseInt(ary[2], 10, 64)
+		errorsOffset, err2 := strconv.ParseInt(ary[3], 10, 64)
+		errorsCount, err3 := strconv.ParseUint(ary[4], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+
+		cp.done[checkpointKey(ary[0], ary[1])] = true
+		cp.listOffset = listOffset
+		cp.errorsOffset = errorsOffset
+		cp.errorsCount = uint(errorsCount)
+	}
+
+	if s.Err() != nil {
+		// non-EOF error.
+		return nil, s.Err()
+	}
+
+	fmt.Println("◆チェックポイントファイルの読み込みを完了しました。")
+	fmt.Printf("　→完了済みエントリ件数 : %d\n", len(cp.done))
+
+	return cp, nil
+}
+
+// path で指定されたファイルを書き込み用に開く。
+// 再開する場合は offset の位置まで切り詰めて追記し、それ以外の場合は既存の内容を削除する。
+func openResumableFile(path string, resumed bool, offset int64) (*os.File, error) {
+	if !resumed {
+		return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	}
+
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := fp.Truncate(offset); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	if _, err := fp.Seek(offset, io.SeekStart); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return fp, nil
+}
+
+// ファイルリストの出力が異常終了した後に、出力しようとした場合のエラー
+var errListWriterStopped = errors.New("ファイルリストの出力が停止しています")
+
+// ファイルリストへ row を出力する。出力が異常終了した場合(done がクローズされた場合)はエラーを返す。
+func sendListRow(filelistCh chan<- listRow, done <-chan struct{}, row listRow) error {
+	select {
+	case filelistCh <- row:
+		return nil
+	case <-done:
+		return errListWriterStopped
+	}
+}
+
+// エントリ name の探索の完了を、チェックポイントファイル fp に記録する。
+// ファイルリストとエラーファイルは、記録する前に書き出す。
+func writeCheckpoint(fp *os.File, filelistCh chan<- listRow, done <-chan struct{}, recorder *walkErrorRecorder, root, name string) error {
+	ack := make(chan int64)
+	if err := sendListRow(filelistCh, done, listRow{checkpoint: ack}); err != nil {
+		return err
+	}
+	var listOffset int64
+	select {
+	case listOffset = <-ack:
+	case <-done:
+		return errListWriterStopped
+	}
+
+	var errorsOffset int64
+	var errorsCount uint
+	if recorder != nil {
+		var err error
+		errorsOffset, errorsCount, err = recorder.flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := fmt.Fprintf(fp, "%s\t%s\t%d\t%d\t%d\n", root, name, listOffset, errorsOffset, errorsCount); err != nil {
+		return err
+	}
+	return fp.Sync()
+}
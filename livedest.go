@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// 比較先をファイルリストの代わりにフォルダから直接取得する場合の比較先の場所
+type LiveDest struct {
+	basePrefix string // 比較元のファイルパスの先頭部分(BASE_DIR)
+	dir        string // 比較先のフォルダ(DEST_FILE_PATH)
+
+	mu      sync.Mutex
+	entries map[string]map[string]string // 読み込んだフォルダごとの、小文字のエントリ名と実際のエントリ名
+}
+
+func newLiveDest(basePrefix, dir string) *LiveDest {
+	return &LiveDest{basePrefix: basePrefix, dir: dir}
+}
+
+// 比較元のファイルパス p に対応する比較先のパスを返す。BASE_DIR 配下でない場合は空文字を返す。
+// 比較先のフォルダが未指定の場合は、p をそのまま比較先のパスとする。
+func (l *LiveDest) destPath(p string) string {
+	if l.dir == "" {
+		return filepath.FromSlash(p)
+	}
+	if !strings.HasPrefix(strings.ToLower(p), strings.ToLower(l.basePrefix)) {
+		return ""
+	}
+	return filepath.Join(l.dir, filepath.FromSlash(p[len(l.basePrefix):]))
+}
+
+// 比較元のファイルパス p に対応する比較先ファイルの情報を取得する。
+// 比較先ファイルが存在しない場合は false を返す。
+func (l *LiveDest) find(p string) (History, bool) {
+	dp := l.resolve(p)
+	if dp == "" {
+		return nil, false
+	}
+
+	info, err := os.Stat(dp)
+	if err != nil || info.IsDir() {
+		return nil, false
+	}
+	return History{&SizeAndDateModified{int(info.Size()), info.ModTime(), "", p}}, true
+}
+
+// 比較元のファイルパス p に対応する、比較先に実在するパスを返す。
+// SPOへアップロードすると大文字に（勝手に）変換される場合があるので、大文字小文字は区別しない。
+// 比較先に存在しない場合は空文字を返す。
+func (l *LiveDest) resolve(p string) string {
+	dp := l.destPath(p)
+	if dp == "" {
+		return ""
+	}
+	return l.resolvePath(dp)
+}
+
+// パス dp を、大文字小文字を区別せずに比較先に実在するパスに変換する。存在しない場合は空文字を返す。
+// 大文字小文字が一致しない場合は、親フォルダの一覧を1度だけ読み込んで検索する。
+func (l *LiveDest) resolvePath(dp string) string {
+	if _, err := os.Lstat(dp); err == nil {
+		return dp
+	}
+
+	parent := filepath.Dir(dp)
+	if parent == dp || dp == l.dir {
+		return ""
+	}
+	parent = l.resolvePath(parent)
+	if parent == "" {
+		return ""
+	}
+
+	name, ok := l.dirEntries(parent)[strings.ToLower(filepath.Base(dp))]
+	if !ok {
+		return ""
+	}
+	return filepath.Join(parent, name)
+}
+
+// フォルダ dir のエントリ名を、小文字のエントリ名をキーとして返す。読み込み結果はキャッシュする。
+func (l *LiveDest) dirEntries(dir string) map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if m, ok := l.entries[dir]; ok {
+		return m
+	}
+	if l.entries == nil {
+		l.entries = make(map[string]map[string]string)
+	}
+
+	// 読み込めない場合は、エントリがないものとする
+	m := make(map[string]string)
+	list, _ := os.ReadDir(dir)
+	for _, e := range list {
+		m[strings.ToLower(e.Name())] = e.Name()
+	}
+	l.entries[dir] = m
+	return m
+}
+
+// フォルダ dir 配下を探索し、n 個のスナップショットのうち i 番目として m に追加する。
+// dir 配下のパスは、BASE_DIR(basePrefix) 配下のパスに置き換える。
+func generateDestMapFromDir(m map[string]History, dir, basePrefix string, i, n int) error {
+	var read, skip, add uint
+	var mu sync.Mutex
+
+	// fn は複数のゴルーチンから並行して呼び出される
+	err := walkTree(dir, &walkOptions{}, func(path string, info os.FileInfo) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		read += 1
+		if info.IsDir() {
+			skip += 1
+			return nil
+		}
+
+		rel := strings.TrimLeft(filepath.ToSlash(strings.TrimPrefix(path, dir)), "/")
+		p := basePrefix + rel
+		key := strings.ToLower(p)
+		h, ok := m[key]
+		if !ok {
+			h = make(History, n)
+			m[key] = h
+		}
+		h[i] = &SizeAndDateModified{int(info.Size()), info.ModTime(), "", p}
+
+		add += 1
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if n > 1 {
+		fmt.Printf("◆チェック先フォルダ(DEST_FILE_PATH)(スナップショット%d)の探索を完了しました。\n", i+1)
+	} else {
+		fmt.Println("◆チェック先フォルダ(DEST_FILE_PATH)の探索を完了しました。")
+	}
+	fmt.Printf("　→探索件数 : %d\n", read)
+	fmt.Printf("　→検索用ファイル件数 : %d\n", add)
+	fmt.Printf("　→スキップ件数(ディレクトリ) : %d\n", skip)
+
+	return nil
+}
+
+// path がフォルダの場合 true を返す。
+func isDirPath(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -13,7 +14,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/saracen/walker"
 	"github.com/urfave/cli/v2"
 )
 
@@ -21,18 +21,34 @@ type File struct {
 	path         string    // ファイルパス
 	size         int       // ファイルサイズ
 	dateModified time.Time // 更新日時
+	hash         string    // ハッシュ値
 }
 
 type SizeAndDateModified struct {
-	Size            int
-	DateModified    time.Time
-	SizeOld         int
-	DateModifiedOld time.Time
+	Size         int
+	DateModified time.Time
+	Hash         string
+	Path         string // ファイルパス(キーと異なり、大文字小文字を変換しない)
+}
+
+// パスごとの比較先ファイルの履歴。
+// インデックスはスナップショットの指定順で、スナップショットに存在しない場合は nil となる。
+type History []*SizeAndDateModified
+
+// 最後に存在するスナップショットを返す。
+func (h History) Latest() *SizeAndDateModified {
+	for i := len(h) - 1; i >= 0; i-- {
+		if h[i] != nil {
+			return h[i]
+		}
+	}
+	return nil
 }
 
 type Unmatch struct {
 	path   string // ファイルのパス
 	reason string // 不一致理由
+	note   string // 備考
 }
 
 const (
@@ -48,9 +64,38 @@ const (
 	compareModeSizeGeAndModGe        // サイズ以上 & 更新日時未来
 )
 
+const (
+	snapshotModeAny    = iota // いずれかのスナップショットと一致すれば真
+	snapshotModeLatest        // 最新のスナップショットと一致すれば真
+	snapshotModeAll           // すべてのスナップショットと一致すれば真
+)
+
+// 比較条件
+type CompareOptions struct {
+	compareMode  int          // 比較モード
+	snapshotMode int          // スナップショットとの一致条件
+	policies     []*Policy    // 拡張子ごとの比較ルール。一致するルールがない場合は比較モードで比較する
+	deep         *DeepCompare // サイズ不一致の Office ドキュメントの内容を比較する場合に指定する
+	verifyHash   bool         // ハッシュ値を比較できる場合は、サイズと更新日時の代わりにハッシュ値で比較する
+	live         *LiveDest    // 比較先を比較元ファイルごとにフォルダから直接取得する場合に指定する
+}
+
 func main() {
-	var baseDir, spoDir, source, dest, destOld, output, ignore, recovery, spopath, trimWord string
+	var baseDir, spoDir, source, dest, destOld, spoList, output, ignore, recovery, spopath, trimWord string
 	var numConcret, verbose int
+	var dests pathList
+	var snapshotMode, policy, sourceDir, hashAlg, columns string
+	var verifyHash, continueOnError bool
+	var errorsPath string
+	var baseDirs, excludes, includeReasons, excludeReasons cli.StringSlice
+	var maxDepth, walkConcurrent, maxFilesPerSec int
+	var maxBytesPerSec, scheduleWindow, archiveBase, unmatch, resolvedPath, defaultStage string
+	var listFormat, rollupPath, deletedPath string
+	var siteURL, library, templatePath, logPath, shardBy, backend, remote, driveID, skippedPath string
+	var graphEndpoint, graphToken, statePath, graphStatePath, escalationPath, reportPath string
+	var maxRetries, maxAttempts int
+	var numShards int
+	var oneFileSystem, followSymlinks, checkpointEnabled, resume, destStat, createFolders, execute, allowEmpty bool
 
 	app := &cli.App{
 		Name:    "pjkakuninja",
@@ -65,14 +110,45 @@ func main() {
 					opsNumConcent(&numConcret),
 					opsBaseDir(&baseDir),
 					opsSource(&source),
-					opsDest(&dest),
+					opsDests(&dests),
 					opsDestOld(&destOld),
+					opsArchiveBase(&archiveBase),
+					opsDestStat(&destStat),
+					opsSnapshotMode(&snapshotMode),
+					opsPolicy(&policy),
+					opsSourceDir(&sourceDir),
 					opsOutput(&output),
 					opsIgnore(&ignore),
 				},
 				Action: func(c *cli.Context) error {
+					mode, err := parseSnapshotMode(snapshotMode)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+
+					// 拡張子ごとの比較ルール
+					policies, err := generatePoliciesPath(policy)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+
+					// 比較元ファイルの格納フォルダが指定された場合は、Office ドキュメントの内容を比較する
+					var deep *DeepCompare
+					if sourceDir != "" {
+						deep = &DeepCompare{modifySourcePathPrifix(baseDir), sourceDir}
+					}
+
+					// チェック先のフォルダを、比較元ファイルごとに直接確認する
+					var live *LiveDest
+					if destStat {
+						if len(dests.Value()) != 1 || destOld != "" || !isDirPath(dests.Value()[0]) {
+							return cli.Exit("比較先を直接確認する場合は、比較先(DEST_FILE_PATH)にフォルダを1つだけ指定してください。", 1)
+						}
+						live = newLiveDest(modifySourcePathPrifix(baseDir), dests.Value()[0])
+					}
+
 					// チェック結果を出力するファイル。既にファイルが存在する場合は削除
-					outFp, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC, 0644)
+					outFp, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 					if err != nil {
 						return cli.Exit(err, 1)
 					}
@@ -81,12 +157,17 @@ func main() {
 					// チェック結果を書き出す専用のゴルーチン
 					resultsCh := make(chan Unmatch, 50) // アンマッチファイルを書き出すためのチャネル
 					done := make(chan struct{})         // ファイル出力終了を伝えるためのチャネル
-					go writeUnMatchFile(resultsCh, outFp, done)
+					writeErrCh := make(chan error, 1)   // ファイル出力のエラーを受け取るためのチャネル
+					go writeUnMatchFile(resultsCh, outFp, done, writeErrCh)
 
 					// チェック先ファイルからチェック用のハッシュマップを生成する
-					destMap, err := generateDestMapFromTempFileListPath(dest, destOld)
-					if err != nil {
-						return cli.Exit(err, 1)
+					// チェック先のフォルダを直接確認する場合は、ハッシュマップを生成しない
+					var destMap map[string]History
+					if live == nil {
+						destMap, err = generateDestMapFromTempFileListPath(appendDestOld(dests.Value(), destOld), archiveBase, baseDir)
+						if err != nil {
+							return cli.Exit(err, 1)
+						}
 					}
 
 					// チェック元
@@ -104,7 +185,7 @@ func main() {
 					var wg sync.WaitGroup
 					for i := 0; i < newNumConcrent; i++ {
 						wg.Add(1)
-						go worker(sourceCh, destMap, resultsCh, compareModeSizeEq, &wg)
+						go worker(sourceCh, destMap, resultsCh, CompareOptions{compareModeSizeEq, mode, policies, deep, false, live}, &wg)
 					}
 					wg.Wait()
 
@@ -113,6 +194,9 @@ func main() {
 
 					// writeUnMatchFile が完了するまで待機
 					<-done
+					if err := <-writeErrCh; err != nil {
+						return cli.Exit(fmt.Sprintf("結果ファイル(OUTPUT_FILE_PATH)の書き込みに失敗しました.(%s)", err), 1)
+					}
 
 					return nil
 				},
@@ -122,11 +206,11 @@ func main() {
 				Aliases: []string{"l"},
 				Usage:   "ファイルリスト作成",
 				Flags: []cli.Flag{
-					&cli.StringFlag{
+					&cli.StringSliceFlag{
 						Name:        "baseDir",
 						Aliases:     []string{"b"},
-						Usage:       "チェック先フォルダのパス `BASE_DIR` を指定します。",
-						Destination: &baseDir,
+						Usage:       "チェック先フォルダのパス `BASE_DIR` を指定します。複数指定できます。アーカイブ(.tar, .tar.gz, .tgz, .zip)も指定できます。",
+						Destination: &baseDirs,
 						Required:    true,
 					},
 					&cli.StringFlag{
@@ -142,40 +226,161 @@ func main() {
 						Usage:       "中間件数の出力件数を指定します。",
 						Destination: &verbose,
 					},
+					opsHash(&hashAlg),
+					opsColumns(&columns),
+					opsContinueOnError(&continueOnError),
+					opsErrors(&errorsPath),
+					opsExclude(&excludes),
+					opsMaxDepth(&maxDepth),
+					opsOneFileSystem(&oneFileSystem),
+					opsFollowSymlinks(&followSymlinks),
+					opsCheckpoint(&checkpointEnabled),
+					opsResume(&resume),
+					opsWalkConcurrent(&walkConcurrent),
+					opsMaxFilesPerSec(&maxFilesPerSec),
+					opsMaxBytesPerSec(&maxBytesPerSec),
+					opsSchedule(&scheduleWindow),
+					opsArchiveBase(&archiveBase),
 				},
 				Action: func(c *cli.Context) error {
-					filelistCh := make(chan string, 50)
-					done := make(chan struct{})
-					go writeFilePathList(filelistCh, output, done, verbose)
+					// ハッシュ値と追加列を出力する場合は、8列目以降に出力する
+					opts, err := newListOptions(hashAlg, columns)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+
+					// 探索の負荷を制限する。1秒あたりのバイト数はハッシュ値の計算に適用する
+					sc, err := parseSchedule(scheduleWindow)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					bytesPerSec := int64(0)
+					if maxBytesPerSec != "" {
+						bytesPerSec, err = parseByteSize(maxBytesPerSec)
+						if err != nil {
+							return cli.Exit(err, 1)
+						}
+					}
+					opts.hashFunc = rateLimitedHashFunc(opts.hashFunc, newRateLimiter(float64(bytesPerSec)))
+
+					walkOpts := &walkOptions{
+						excludes:       excludes.Value(),
+						maxDepth:       maxDepth,
+						oneFileSystem:  oneFileSystem,
+						followSymlinks: followSymlinks,
+						throttle: &walkThrottle{
+							concurrent: walkConcurrent,
+							files:      newRateLimiter(float64(maxFilesPerSec)),
+							schedule:   sc,
+						},
+					}
+
+					// 再開する場合は、チェックポイントファイルから途中経過を読み込む
+					checkpointPath := output + ".checkpoint"
+					cp := &checkpoint{done: make(map[string]bool)}
+					if resume {
+						cp, err = loadCheckpoint(checkpointPath)
+						if err != nil {
+							return cli.Exit(err, 1)
+						}
+					}
 
-					err := walker.Walk(baseDir, func(path string, info os.FileInfo) error {
-						if path == baseDir {
-							return nil
+					// エラーを無視する場合は、読み込めなかったパスをエラーファイルに記録する
+					var recorder *walkErrorRecorder
+					if continueOnError {
+						if errorsPath == "" {
+							errorsPath = output + ".errors"
+						}
+						recorder, err = newWalkErrorRecorder(errorsPath, cp)
+						if err != nil {
+							return cli.Exit(err, 1)
 						}
+						// 探索を中断した場合も、記録済みのエラーを書き出す
+						defer recorder.Close()
+						walkOpts.recorder = recorder
+					}
+
+					filelistCh := make(chan listRow, 50)
+					done := make(chan struct{})
+					writeErrCh := make(chan error, 1) // ファイルリストの出力エラーを受け取るためのチャネル
+					go writeFilePathList(filelistCh, output, cp, done, writeErrCh, verbose)
 
-						filename := info.Name() // ファイル名
-						ext := ""               // ファイルの拡張子
-						size := info.Size()     // ファイルサイズ
-						folderFlag := "FALSE"
-						if info.IsDir() {
-							folderFlag = "TRUE"
+					fn := func(path string, info os.FileInfo) error {
+						s, err := opts.line(path, info)
+						if err != nil {
+							return walkOpts.handleError(path, err)
 						}
-						updateDate := info.ModTime().Format("2006/01/02") // 更新日
-						updateTime := info.ModTime().Format("15:04:05")   // 更新時刻
+						return sendListRow(filelistCh, done, listRow{line: s})
+					}
 
-						// "ファイル名","ファイルのフルパス","ファイルの拡張子",ファイルサイズ,フォルダフラグ(フォルダの場合TRUE),更新日,更新時刻
-						s := fmt.Sprintf("\"%s\",\"%s\",\"%s\",%d,%s,%s,%s", filename, path, ext, size, folderFlag, updateDate, updateTime)
-						filelistCh <- s
+					// チェックポイントを記録する場合は、BASE_DIR 直下のエントリごとに探索する
+					var cpFp *os.File
+					if checkpointEnabled || resume {
+						flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+						if resume {
+							flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+						}
+						cpFp, err = os.OpenFile(checkpointPath, flag, 0644)
+						if err != nil {
+							return cli.Exit(err, 1)
+						}
+						defer cpFp.Close()
+					}
 
-						return nil
-					})
+					// BASE_DIR ごとに、指定順に探索する
+					for _, root := range baseDirs.Value() {
+						if isArchivePath(root) {
+							// アーカイブは、全体を1つのエントリとしてチェックポイントに記録する
+							if cpFp != nil && cp.done[checkpointKey(root, checkpointFiles)] {
+								continue
+							}
+							err = walkArchive(root, archiveBaseDir(root, archiveBase), walkOpts, fn)
+							if err == nil && cpFp != nil {
+								err = writeCheckpoint(cpFp, filelistCh, done, recorder, root, checkpointFiles)
+							}
+						} else if cpFp == nil {
+							err = walkTree(root, walkOpts, fn)
+						} else {
+							err = walkTreeByEntry(root, walkOpts, fn, func(name string) bool {
+								return cp.done[checkpointKey(root, name)]
+							}, func(name string) error {
+								return writeCheckpoint(cpFp, filelistCh, done, recorder, root, name)
+							})
+						}
+						if err != nil {
+							break
+						}
+					}
 					close(filelistCh)
 
+					// エラーで中断した場合も、出力済みのファイルリストを書き出す
+					<-done
+					if writeErr := <-writeErrCh; writeErr != nil {
+						return cli.Exit(fmt.Sprintf("ファイルリストの出力に失敗しました.(%s)", writeErr), 1)
+					}
+
 					if err != nil {
-						return err
+						return cli.Exit(fmt.Sprintf("ファイルリストの作成を中断しました.(%s)", err), 1)
 					}
 
-					<-done
+					// 最後まで探索した場合は、チェックポイントファイルを削除する
+					if cpFp != nil {
+						cpFp.Close()
+						if err := os.Remove(checkpointPath); err != nil {
+							return cli.Exit(err, 1)
+						}
+					}
+
+					if recorder != nil {
+						if err := recorder.Close(); err != nil {
+							return cli.Exit(err, 1)
+						}
+						fmt.Println("◆エラーファイル(ERRORS_FILE_PATH)の出力を完了しました。")
+						fmt.Printf("　→スキップ件数(エラー) : %d\n", recorder.count)
+						if recorder.count > 0 {
+							return cli.Exit("読み込めなかったパスがあるため、ファイルリストは一部のみ出力されています。", 1)
+						}
+					}
 
 					return nil
 				},
@@ -189,13 +394,27 @@ func main() {
 					opsBaseDir(&baseDir),
 					opsSPODir(&spoDir),
 					opsSource(&source),
-					opsDest(&dest),
+					opsArchiveBase(&archiveBase),
+					opsDestNonRequired(&dest),
+					opsGraphState(&graphStatePath),
+					opsGraphEndpoint(&graphEndpoint),
+					opsGraphToken(&graphToken),
+					opsDriveID(&driveID),
+					opsMaxRetries(&maxRetries),
+					opsPolicy(&policy),
+					opsVerifyHash(&verifyHash),
 					opsOutput(&output),
 					opsIgnore(&ignore),
 				},
 				Action: func(c *cli.Context) error {
+					// 拡張子ごとの比較ルール
+					policies, err := generatePoliciesPath(policy)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+
 					// チェック結果を出力するファイル。既にファイルが存在する場合は削除
-					outFp, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC, 0644)
+					outFp, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 					if err != nil {
 						return cli.Exit(err, 1)
 					}
@@ -204,10 +423,112 @@ func main() {
 					// チェック結果を書き出す専用のゴルーチン
 					resultsCh := make(chan Unmatch, 50) // アンマッチファイルを書き出すためのチャネル
 					done := make(chan struct{})         // ファイル出力終了を伝えるためのチャネル
-					go writeUnMatchFile(resultsCh, outFp, done)
+					writeErrCh := make(chan error, 1)   // ファイル出力のエラーを受け取るためのチャネル
+					go writeUnMatchFile(resultsCh, outFp, done, writeErrCh)
 
 					// チェック先ファイルからチェック用のハッシュマップを生成する
-					destMap, err := generateDestMapFromSPOFileListPath(dest, baseDir, spoDir)
+					// 状態ファイルが指定された場合は、Microsoft Graph でライブラリから直接取得する
+					var destMap map[string]History
+					switch {
+					case graphStatePath != "":
+						client, err := newGraphClient(graphEndpoint, graphToken, driveID, maxRetries)
+						if err != nil {
+							return cli.Exit(err, 1)
+						}
+						destMap, err = generateDestMapFromGraph(client, graphStatePath, baseDir, spoDir)
+						if err != nil {
+							return cli.Exit(err, 1)
+						}
+					case dest != "":
+						destMap, err = generateDestMapFromSPOFileListPath(dest, baseDir, spoDir)
+						if err != nil {
+							return cli.Exit(err, 1)
+						}
+					default:
+						return cli.Exit("DEST_FILE_PATH または GRAPH_STATE_FILE_PATH を指定してください", 1)
+					}
+
+					// チェック元
+					srcFp, err := openTempFileList(source, archiveBase)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					defer srcFp.Close()
+					sourceCh := generateSourceFromTempFileList(srcFp, ignore)
+
+					// NUM_CONCURRENT が未指定の場合は、CPU数の半分とする。
+					newNumConcrent := getNumConcrent(numConcret)
+
+					// ワーカーを生成
+					var wg sync.WaitGroup
+					for i := 0; i < newNumConcrent; i++ {
+						wg.Add(1)
+						go worker(sourceCh, destMap, resultsCh, CompareOptions{compareModeSizeGeAndModGe, snapshotModeAny, policies, nil, verifyHash, nil}, &wg)
+					}
+					wg.Wait()
+
+					// ワーカーがすべて完了すると、resultsCh への送信が完了するのでクローズする
+					close(resultsCh)
+
+					// writeUnMatchFile が完了するまで待機
+					<-done
+					if err := <-writeErrCh; err != nil {
+						return cli.Exit(fmt.Sprintf("結果ファイル(OUTPUT_FILE_PATH)の書き込みに失敗しました.(%s)", err), 1)
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:    "check-all",
+				Aliases: []string{"ca"},
+				Usage:   "P-WEB→TEMP→SPOの一括ファイルマッチング",
+				Flags: []cli.Flag{
+					opsNumConcent(&numConcret),
+					opsBaseDir(&baseDir),
+					opsSPODir(&spoDir),
+					opsSource(&source),
+					opsDests(&dests),
+					opsDestOld(&destOld),
+					opsArchiveBase(&archiveBase),
+					opsSnapshotMode(&snapshotMode),
+					opsSPOList(&spoList),
+					opsSPOPolicy(&policy),
+					opsOutput(&output),
+					opsIgnore(&ignore),
+				},
+				Action: func(c *cli.Context) error {
+					mode, err := parseSnapshotMode(snapshotMode)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+
+					// 拡張子ごとの比較ルール
+					policies, err := generatePoliciesPath(policy)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+
+					// チェック結果を出力するファイル。既にファイルが存在する場合は削除
+					outFp, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					defer outFp.Close()
+
+					// チェック結果を書き出す専用のゴルーチン
+					resultsCh := make(chan StageUnmatch, 50) // アンマッチファイルを書き出すためのチャネル
+					done := make(chan struct{})              // ファイル出力終了を伝えるためのチャネル
+					go writeStageUnMatchFile(resultsCh, outFp, done)
+
+					// TEMPのファイルリストからチェック用のハッシュマップを生成する
+					tempMap, err := generateDestMapFromTempFileListPath(appendDestOld(dests.Value(), destOld), archiveBase, baseDir)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+
+					// SPOのファイルリストからチェック用のハッシュマップを生成する
+					spoMap, err := generateDestMapFromSPOFileListPath(spoList, baseDir, spoDir)
 					if err != nil {
 						return cli.Exit(err, 1)
 					}
@@ -218,7 +539,7 @@ func main() {
 						return cli.Exit(err, 1)
 					}
 					defer srcFp.Close()
-					sourceCh := generateSourceFromTempFileList(srcFp, ignore)
+					sourceCh := generateSourceFromPJFileList(srcFp, baseDir, ignore)
 
 					// NUM_CONCURRENT が未指定の場合は、CPU数の半分とする。
 					newNumConcrent := getNumConcrent(numConcret)
@@ -227,14 +548,15 @@ func main() {
 					var wg sync.WaitGroup
 					for i := 0; i < newNumConcrent; i++ {
 						wg.Add(1)
-						go worker(sourceCh, destMap, resultsCh, compareModeSizeGeAndModGe, &wg)
+						// P-WEB → TEMP のコピーは完全に一致するはずのため、比較ルールは TEMP → SPO のみに適用する
+						go stageWorker(sourceCh, tempMap, spoMap, resultsCh, CompareOptions{compareModeSizeEq, mode, nil, nil, false, nil}, CompareOptions{compareModeSizeGeAndModGe, snapshotModeAny, policies, nil, false, nil}, &wg)
 					}
 					wg.Wait()
 
 					// ワーカーがすべて完了すると、resultsCh への送信が完了するのでクローズする
 					close(resultsCh)
 
-					// writeUnMatchFile が完了するまで待機
+					// writeStageUnMatchFile が完了するまで待機
 					<-done
 
 					return nil
@@ -246,11 +568,39 @@ func main() {
 				Usage:   "SPOへの再送信",
 				Flags: []cli.Flag{
 					opsRecovery(&recovery),
+					opsIncludeReason(&includeReasons),
+					opsExcludeReason(&excludeReasons),
 					opsOutput(&output),
+					opsSkipped(&skippedPath),
 					opsTrimWord(&trimWord),
 					opsSpopath(&spopath),
+					opsBackend(&backend),
+					opsSiteURL(&siteURL),
+					opsLibrary(&library),
+					opsRemote(&remote),
+					opsDriveID(&driveID),
+					opsExecute(&execute),
+					opsGraphEndpoint(&graphEndpoint),
+					opsGraphToken(&graphToken),
+					opsState(&statePath),
+					opsMaxRetries(&maxRetries),
+					opsTemplate(&templatePath),
+					opsLog(&logPath),
+					opsCreateFolders(&createFolders),
+					opsShards(&numShards),
+					opsShardBy(&shardBy),
+					opsSizeList(&dest),
 				},
 				Action: func(c *cli.Context) error {
+					// 再送信スクリプトの出力形式
+					if backend == recoveryBackendM365 && siteURL == "" {
+						return cli.Exit("m365 の場合は、サイトのURL(SITE_URL)を指定してください", 1)
+					}
+					rw, err := newRecoveryWriter(backend, templatePath, remote, driveID)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+
 					// リカバリリスト
 					recFp, err := os.Open(recovery)
 					if err != nil {
@@ -258,105 +608,483 @@ func main() {
 					}
 					defer recFp.Close()
 
-					// チェック結果を出力するファイル。既にファイルが存在する場合は削除
-					outFp, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC, 0644)
+					filter, err := newReasonFilter(includeReasons.Value(), excludeReasons.Value())
 					if err != nil {
 						return cli.Exit(err, 1)
 					}
-					defer outFp.Close()
-
-					bw := bufio.NewWriter(outFp)
-					defer bw.Flush()
-
-					var read, write uint
+					items, skips, read, err := generateRecoveryItems(recFp, trimWord, spopath, filter)
+					if err != nil {
+						return err
+					}
 
-					s := bufio.NewScanner(recFp)
-					for s.Scan() {
-						read += 1
+					// 再送信対象としなかった行を出力するファイル。既にファイルが存在する場合は削除
+					if skippedPath == "" {
+						skippedPath = output + ".skipped"
+					}
+					skippedFp, err := os.OpenFile(skippedPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					defer skippedFp.Close()
+					if err := writeRecoverySkips(skips, skippedFp); err != nil {
+						return cli.Exit(err, 1)
+					}
 
-						ary := strings.Split(s.Text(), ",")
-						if len(ary) != 2 {
-							return fmt.Errorf("ファイルリストのフォーマット不正. len=%d", len(ary))
+					// SPOへのアップロードを直接実行する
+					if execute {
+						client, err := newGraphClient(graphEndpoint, graphToken, driveID, maxRetries)
+						if err != nil {
+							return cli.Exit(err, 1)
+						}
+						if statePath == "" {
+							statePath = output + ".state"
+						}
+						state, err := loadGraphUploadState(statePath)
+						if err != nil {
+							return cli.Exit(err, 1)
 						}
 
-						filePath := ary[1]
-						dirPath := filePath[strings.Index(filePath, "/"):strings.LastIndex(filePath, "/")]
-						if trimWord != "" {
-							if !strings.HasPrefix(trimWord, "/") {
-								trimWord = "/" + trimWord
-							}
-							dirPath = strings.TrimPrefix(dirPath, trimWord)
+						// アップロードの結果を出力するファイル。既にファイルが存在する場合は削除
+						outFp, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+						if err != nil {
+							return cli.Exit(err, 1)
 						}
-						if spopath != "" {
-							if !strings.HasPrefix(spopath, "/") {
-								spopath = "/" + spopath
-							}
-							dirPath = fmt.Sprintf("%s%s", spopath, dirPath)
+						defer outFp.Close()
+
+						err = executeGraphUploads(client, items, state, outFp)
+						fmt.Printf("　→ファイル入力件数 : %d\n", read)
+						fmt.Printf("　→ファイル送信対象件数 : %d\n", len(items))
+						if err != nil {
+							return cli.Exit(err, 1)
 						}
 
-						AddPngCmd := fmt.Sprintf("Add-PnPFile -Path \"%s\" -Folder \"Shared%%20Documents%s\"\n", strings.Replace(filePath, "$", "`$", -1), strings.Replace(dirPath, "$", "`$", -1))
+						return nil
+					}
 
-						if _, err := bw.WriteString(AddPngCmd); err != nil {
-							return err
+					// TEMPのファイルリストが指定された場合は、ファイルサイズを設定する
+					if dest != "" {
+						destMap, err := generateDestMapFromTempFileListPath([]string{dest}, "", "")
+						if err != nil {
+							return cli.Exit(err, 1)
+						}
+						if unknown := setRecoveryItemSizes(items, destMap); unknown > 0 {
+							fmt.Printf("◆ファイルサイズが不明なファイルがあります。(%d 件)\n", unknown)
 						}
-						write += 1
 					}
 
-					if s.Err() != nil {
-						// non-EOF error.
-						return s.Err()
+					// 複数のスクリプトに分割する
+					// ファイルサイズが不明な場合は、ファイルサイズの合計で分割できないため、ファイル数で分割する
+					if numShards > 1 && shardBy == shardByBytes && dest == "" {
+						fmt.Println("◆TEMPのファイルリスト(DEST_FILE_PATH)が未指定でファイルサイズが不明なため、ファイル数で分割します。")
+						shardBy = shardByCount
+					}
+					shards, err := shardRecoveryItems(items, numShards, shardBy)
+					if err != nil {
+						return cli.Exit(err, 1)
 					}
 
+					base := RecoveryScript{siteURL, library, logPath, "", nil, nil}
+					if err := writeRecoveryScripts(output, rw, base, shards, createFolders); err != nil {
+						return cli.Exit(err, 1)
+					}
 					fmt.Println("◆リカバリファイル(RECOVERY_FILE_PATH)の出力を完了しました。")
+					printRecoveryShards(output, shards)
 					fmt.Printf("　→ファイル入力件数 : %d\n", read)
-					fmt.Printf("　→ファイル出力件数 : %d\n", write)
+					fmt.Printf("　→ファイル出力件数 : %d\n", len(items))
 
 					return nil
 				},
 			},
 			{
-				Name:    "dummy-temp-list",
-				Aliases: []string{"d"},
-				Usage:   "ダミーのテンポラリストレージファイルリスト作成",
+				Name:    "recovery-temp",
+				Aliases: []string{"rt"},
+				Usage:   "TEMPへの再コピー",
 				Flags: []cli.Flag{
-					opsSource(&source),
-					opsOutput(&output),
-					opsDestNonRequired(&dest),
-					opsDestOld(&destOld),
+					opsUnmatch(&unmatch),
 					opsBaseDir(&baseDir),
+					opsCopySourceDir(&sourceDir),
+					opsTempBackend(&backend),
+					opsOutput(&output),
 				},
 				Action: func(c *cli.Context) error {
-					// PJWEBリスト
-					srcFp, err := os.Open(source)
+					if backend != tempBackendRobocopy && backend != tempBackendRsync {
+						return cli.Exit(fmt.Sprintf("再コピースクリプトの出力形式が不正です. BACKEND=%s", backend), 1)
+					}
+
+					// チェック結果ファイル
+					unmatchFp, err := os.Open(unmatch)
 					if err != nil {
 						return cli.Exit(err, 1)
 					}
-					defer srcFp.Close()
+					defer unmatchFp.Close()
 
-					// チェック結果を出力するファイル。既にファイルが存在する場合は削除
-					outFp, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC, 0644)
+					items, read, skip, err := generateTempRecoveryItems(unmatchFp, modifySourcePathPrifix(baseDir))
 					if err != nil {
 						return cli.Exit(err, 1)
 					}
-					defer outFp.Close()
 
-					bw := bufio.NewWriter(outFp)
-					defer bw.Flush()
+					fmt.Println("◆チェック結果ファイル(UNMATCH_FILE_PATH)の読み込みを完了しました。")
+					fmt.Printf("　→読み込み件数 : %d\n", read)
+					fmt.Printf("　→スキップ件数 : %d\n", skip)
+					fmt.Printf("　→再コピー対象件数 : %d\n", len(items))
 
-					// チェック先ファイルからチェック用のハッシュマップを生成する
-					var destMap map[string]*SizeAndDateModified
-					if dest != "" {
-						destMap, err = generateDestMapFromTempFileListPath(dest, destOld)
+					// 再コピースクリプトを出力するファイル。既にファイルが存在する場合は削除
+					outFp, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					defer outFp.Close()
+
+					if backend == tempBackendRobocopy {
+						n, err := writeRobocopyScript(outFp, items, modifySourcePathPrifix(sourceDir), modifySourcePathPrifix(baseDir))
 						if err != nil {
 							return cli.Exit(err, 1)
 						}
+						fmt.Println("◆再コピースクリプト(OUTPUT_FILE_PATH)の出力を完了しました。")
+						fmt.Printf("　→robocopy 件数 : %d\n", n)
+					} else {
+						if err := writeRsyncScript(outFp, items, modifySourcePathPrifix(sourceDir), modifySourcePathPrifix(baseDir)); err != nil {
+							return cli.Exit(err, 1)
+						}
+						fmt.Println("◆再コピースクリプト(OUTPUT_FILE_PATH)の出力を完了しました。")
 					}
+					fmt.Printf("　→ファイル出力件数 : %d\n", len(items))
 
-					var read, write uint
+					return nil
+				},
+			},
+			{
+				Name:    "recheck",
+				Aliases: []string{"rc"},
+				Usage:   "チェック結果の再確認",
+				Flags: []cli.Flag{
+					opsNumConcent(&numConcret),
+					opsUnmatch(&unmatch),
+					opsSourceNonRequired(&source),
+					opsBaseDirNonRequired(&baseDir),
+					opsPolicy(&policy),
+					opsOutput(&output),
+					opsResolved(&resolvedPath),
+					opsDefaultStage(&defaultStage),
+				},
+				Action: func(c *cli.Context) error {
+					if defaultStage != "" && defaultStage != StageTemp && defaultStage != StageSPO {
+						return cli.Exit(fmt.Sprintf("段階が不正です. STAGE=%s", defaultStage), 1)
+					}
 
-					// "プロジェクト名","カテゴリ","サブカテゴリ",ファイルパス,ファイルサイズ
-					s := bufio.NewScanner(srcFp)
-					for s.Scan() {
+					// 拡張子ごとの比較ルール
+					policies, err := generatePoliciesPath(policy)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+
+					// 比較元ファイルが指定された場合は、比較元のファイルサイズと比較する
+					recheck := &Recheck{stage: defaultStage, opts: CompareOptions{compareModeSizeEq, snapshotModeAny, policies, nil, false, newLiveDest("", "")}}
+					if source != "" {
+						srcFp, err := os.Open(source)
+						if err != nil {
+							return cli.Exit(err, 1)
+						}
+						recheck.sourceMap = generateSourceMapFromPJFileList(srcFp, baseDir)
+						srcFp.Close()
+					}
+
+					// 未解消の行を出力するファイル。既にファイルが存在する場合は削除
+					outFp, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					defer outFp.Close()
+
+					// 解消した行を出力するファイル。既にファイルが存在する場合は削除
+					if resolvedPath == "" {
+						resolvedPath = output + ".resolved"
+					}
+					resolvedFp, err := os.OpenFile(resolvedPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					defer resolvedFp.Close()
+
+					// 再確認結果を書き出す専用のゴルーチン
+					resultsCh := make(chan RecheckResult, 50)
+					done := make(chan struct{})
+					go writeRecheckFile(resultsCh, outFp, resolvedFp, done)
+
+					// チェック結果
+					unmatchFp, err := os.Open(unmatch)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					defer unmatchFp.Close()
+					rowCh := generateUnmatchRows(unmatchFp)
+
+					// NUM_CONCURRENT が未指定の場合は、CPU数の半分とする。
+					newNumConcrent := getNumConcrent(numConcret)
+
+					// ワーカーを生成
+					var wg sync.WaitGroup
+					for i := 0; i < newNumConcrent; i++ {
+						wg.Add(1)
+						go recheckWorker(rowCh, recheck, resultsCh, &wg)
+					}
+					wg.Wait()
+
+					// ワーカーがすべて完了すると、resultsCh への送信が完了するのでクローズする
+					close(resultsCh)
+
+					// writeRecheckFile が完了するまで待機
+					<-done
+
+					return nil
+				},
+			},
+			{
+				Name:    "cycle",
+				Aliases: []string{"cy"},
+				Usage:   "リカバリサイクルの追跡",
+				Flags: []cli.Flag{
+					opsUnmatch(&unmatch),
+					opsCycleState(&statePath),
+					opsMaxAttempts(&maxAttempts),
+					opsOutput(&output),
+					opsEscalation(&escalationPath),
+					opsReport(&reportPath),
+					opsAllowEmpty(&allowEmpty),
+				},
+				Action: func(c *cli.Context) error {
+					if maxAttempts < 1 {
+						return cli.Exit(fmt.Sprintf("再送信回数の上限が不正です. MAX_ATTEMPTS=%d", maxAttempts), 1)
+					}
+
+					// 前回までの状態
+					state, err := loadCycleState(statePath)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+
+					// 最新のチェック結果ファイル
+					unmatchFp, err := os.Open(unmatch)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					defer unmatchFp.Close()
+
+					// 記録済みのチェック結果ファイルは、再送信回数を誤って加算しないように受け付けない
+					info, err := unmatchFp.Stat()
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					g, err := newCycleGeneration(unmatch, info)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					if n, ok := state.recorded(g); ok {
+						return cli.Exit(fmt.Sprintf("チェック結果ファイルは第%d世代として記録済みです。再送信後に再度チェックした結果を指定してください. UNMATCH_FILE_PATH=%s", n, unmatch), 1)
+					}
+
+					rows, read, skip, invalid, err := readUnmatchRows(unmatchFp)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					fmt.Println("◆チェック結果ファイル(UNMATCH_FILE_PATH)の読み込みを完了しました。")
+					fmt.Printf("　→読み込み件数 : %d\n", read)
+					fmt.Printf("　→スキップ件数 : %d\n", skip)
+					fmt.Printf("　→不一致件数 : %d\n", len(rows))
+					if invalid > 0 {
+						fmt.Printf("◆解析できない行があるため、今回の結果にないファイルを解消とせず、未確認とします。(%d 件)\n", invalid)
+					}
+
+					// 出力に失敗したチェック結果ファイルで、すべてのファイルを解消としないようにする
+					if len(rows) == 0 && len(state.Files) > 0 && !allowEmpty {
+						return cli.Exit(fmt.Sprintf("チェック結果ファイルに不一致の行がありません。未解消のファイル(%d 件)をすべて解消とする場合は、--allow-empty を指定してください. UNMATCH_FILE_PATH=%s", len(state.Files), unmatch), 1)
+					}
+
+					g.Skipped = invalid
+					results := state.next(rows, maxAttempts, g)
+
+					// 再送信の対象を出力するファイル。既にファイルが存在する場合は削除
+					outFp, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					defer outFp.Close()
+
+					// エスカレーションの対象を出力するファイル。既にファイルが存在する場合は削除
+					if escalationPath == "" {
+						escalationPath = output + ".escalation"
+					}
+					escalationFp, err := os.OpenFile(escalationPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					defer escalationFp.Close()
+
+					// すべての判定結果を出力するファイル。既にファイルが存在する場合は削除
+					if reportPath == "" {
+						reportPath = output + ".report"
+					}
+					reportFp, err := os.OpenFile(reportPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					defer reportFp.Close()
+
+					if err := writeCycleResults(results, outFp, escalationFp, reportFp); err != nil {
+						return cli.Exit(err, 1)
+					}
+
+					// 結果の出力が完了してから状態を保存する
+					if err := state.save(); err != nil {
+						return cli.Exit(err, 1)
+					}
+					fmt.Printf("◆状態ファイル(STATE_FILE_PATH)に第%d世代を記録しました。\n", len(state.Generations))
+
+					return nil
+				},
+			},
+			{
+				Name:    "diff-list",
+				Aliases: []string{"dl"},
+				Usage:   "ファイルリストの差分",
+				Flags: []cli.Flag{
+					opsListFormat(&listFormat),
+					opsSource(&source),
+					opsDest(&dest),
+					opsBaseDirNonRequired(&baseDir),
+					opsSPODirNonRequired(&spoDir),
+					opsOutput(&output),
+					opsRollup(&rollupPath),
+				},
+				Action: func(c *cli.Context) error {
+					// 旧(SOURCE_FILE_PATH)を1番目、新(DEST_FILE_PATH)を2番目のスナップショットとして読み込む
+					m, err := generateDiffMap(listFormat, source, dest, baseDir, spoDir)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					diffs := diffLists(m)
+
+					// 差分を出力するファイル。既にファイルが存在する場合は削除
+					outFp, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					defer outFp.Close()
+
+					if err := writeListDiffs(diffs, outFp); err != nil {
+						return cli.Exit(err, 1)
+					}
+
+					// フォルダごとの集計を出力するファイル。既にファイルが存在する場合は削除
+					if rollupPath == "" {
+						rollupPath = output + ".folders"
+					}
+					rollupFp, err := os.OpenFile(rollupPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					defer rollupFp.Close()
+
+					if err := writeFolderDiffs(rollupListDiffs(diffs), rollupFp); err != nil {
+						return cli.Exit(err, 1)
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:    "delta-pweb",
+				Aliases: []string{"dp"},
+				Usage:   "P-WEBファイルリストの差分(追加・変更・削除)抽出",
+				Flags: []cli.Flag{
+					opsSource(&source),
+					opsDest(&dest),
+					opsOutput(&output),
+					opsDeleted(&deletedPath),
+				},
+				Action: func(c *cli.Context) error {
+					// 旧(SOURCE_FILE_PATH)の P-WEB リスト
+					oldFp, err := os.Open(source)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					defer oldFp.Close()
+
+					// 新(DEST_FILE_PATH)の P-WEB リスト
+					newFp, err := os.Open(dest)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					defer newFp.Close()
+
+					// 追加・変更されたファイルを出力するファイル。既にファイルが存在する場合は削除
+					outFp, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					defer outFp.Close()
+
+					// 削除されたファイルを出力するファイル。既にファイルが存在する場合は削除
+					if deletedPath == "" {
+						deletedPath = output + ".deleted"
+					}
+					deletedFp, err := os.OpenFile(deletedPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					defer deletedFp.Close()
+
+					if err := writePJFileListDelta(oldFp, newFp, outFp, deletedFp); err != nil {
+						return cli.Exit(err, 1)
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:    "dummy-temp-list",
+				Aliases: []string{"d"},
+				Usage:   "ダミーのテンポラリストレージファイルリスト作成",
+				Flags: []cli.Flag{
+					opsSource(&source),
+					opsOutput(&output),
+					opsDestNonRequired(&dest),
+					opsDestOld(&destOld),
+					opsArchiveBase(&archiveBase),
+					opsBaseDir(&baseDir),
+				},
+				Action: func(c *cli.Context) error {
+					// PJWEBリスト
+					srcFp, err := os.Open(source)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					defer srcFp.Close()
+
+					// チェック結果を出力するファイル。既にファイルが存在する場合は削除
+					outFp, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					defer outFp.Close()
+
+					bw := bufio.NewWriter(outFp)
+					defer bw.Flush()
+
+					// チェック先ファイルからチェック用のハッシュマップを生成する
+					var destMap map[string]History
+					if dest != "" {
+						destMap, err = generateDestMapFromTempFileListPath(appendDestOld([]string{dest}, destOld), archiveBase, baseDir)
+						if err != nil {
+							return cli.Exit(err, 1)
+						}
+					}
+
+					var read, write uint
+
+					// "プロジェクト名","カテゴリ","サブカテゴリ",ファイルパス,ファイルサイズ
+					s := bufio.NewScanner(srcFp)
+					for s.Scan() {
 						read += 1
 
 						ary := strings.Split(s.Text(), ",")
@@ -372,21 +1100,13 @@ func main() {
 						size := ary[4]
 						updateDate := "2022/3/5"
 						updateTime := "15:04:05"
-						if v, ok := destMap[strings.ToLower(path)]; ok {
-							if v.SizeOld != 0 {
-								updateDate = v.DateModifiedOld.Format("2006/01/02")
-								if v.DateModifiedOld.Hour() < 12 {
-									updateTime = v.DateModifiedOld.Format("3:04:05")
-								} else {
-									updateTime = v.DateModifiedOld.Format("15:04:05")
-								}
+						if h, ok := destMap[strings.ToLower(path)]; ok {
+							v := h.Latest()
+							updateDate = v.DateModified.Format("2006/01/02")
+							if v.DateModified.Hour() < 12 {
+								updateTime = v.DateModified.Format("3:04:05")
 							} else {
-								updateDate = v.DateModified.Format("2006/01/02")
-								if v.DateModified.Hour() < 12 {
-									updateTime = v.DateModified.Format("3:04:05")
-								} else {
-									updateTime = v.DateModified.Format("15:04:05")
-								}
+								updateTime = v.DateModified.Format("15:04:05")
 							}
 						}
 
@@ -402,6 +1122,9 @@ func main() {
 						// non-EOF error.
 						return s.Err()
 					}
+					if err := bw.Flush(); err != nil {
+						return cli.Exit(err, 1)
+					}
 
 					fmt.Println("◆リカバリファイル(RECOVERY_FILE_PATH)の出力を完了しました。")
 					fmt.Printf("　→ファイル入力件数 : %d\n", read)
@@ -419,30 +1142,28 @@ func main() {
 	}
 }
 
-// r で指定されたファイルから、チェック用のマップを生成する。
-// r の1行は次の構成。
-// "ファイル名","ファイルのフルパス","ファイルの拡張子",ファイルサイズ,フォルダフラグ(フォルダの場合TRUE),更新日,更新時刻
-func generateDestMapFromTempFileList(rBe io.Reader) (map[string]*SizeAndDateModified, error) {
-	m := make(map[string]*SizeAndDateModified)
-	var readBe, skipBe, addBe uint
-
-	// 処理前ファイル
-	sBe := bufio.NewScanner(rBe)
-	for sBe.Scan() {
-		readBe += 1
-		if sBe.Text() == "" {
-			skipBe += 1
+// r で指定されたファイルを、n 個のスナップショットのうち i 番目として m に追加する。
+// r の1行は次の構成。8列目以降は省略可能。
+// "ファイル名","ファイルのフルパス","ファイルの拡張子",ファイルサイズ,フォルダフラグ(フォルダの場合TRUE),更新日,更新時刻,"ハッシュ値"
+func generateDestMapFromTempFileList(m map[string]History, r io.Reader, i, n int) error {
+	var read, skip, add uint
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		read += 1
+		if s.Text() == "" {
+			skip += 1
 			continue
 		}
 
-		ary := strings.Split(sBe.Text(), ",")
-		if len(ary) != 7 {
-			return nil, fmt.Errorf("ファイルリストのフォーマット不正. len=%d", len(ary))
+		ary := strings.Split(s.Text(), ",")
+		if len(ary) < 7 {
+			return fmt.Errorf("ファイルリストのフォーマット不正. len=%d", len(ary))
 		}
 
 		// フォルダフラグが "TRUE" の場合はチェック対象外のためスキップする
 		if ary[4] == "TRUE" {
-			skipBe += 1
+			skip += 1
 			continue
 		}
 
@@ -453,83 +1174,41 @@ func generateDestMapFromTempFileList(rBe io.Reader) (map[string]*SizeAndDateModi
 		if err != nil {
 			d = time.Time{}
 		}
-		m[strings.ToLower(p)] = &SizeAndDateModified{size, d, 0, time.Time{}}
-		// m[strings.ToLower(p)] = &SizeAndDateModified{size, time.Time{}, 0, time.Time{}}
-
-		addBe += 1
-	}
-
-	if sBe.Err() != nil {
-		// non-EOF error.
-		return nil, sBe.Err()
-	}
-
-	fmt.Println("◆チェック先ファイル(DEST_FILE_PATH)の読み込みを完了しました。")
-	fmt.Printf("　→ファイル読み込み件数 : %d\n", readBe)
-	fmt.Printf("　→検索用ファイル件数 : %d\n", addBe)
-	fmt.Printf("　→スキップ件数(ディレクトリ) : %d\n", skipBe)
-
-	return m, nil
-}
-
-func updateDestMapFromTempFileList(m map[string]*SizeAndDateModified, rAf io.Reader) (map[string]*SizeAndDateModified, error) {
-	var readAf, skipAf, updateAf uint
-
-	// 処理後ファイル
-	sAf := bufio.NewScanner(rAf)
-	for sAf.Scan() {
-		readAf += 1
-		if sAf.Text() == "" {
-			skipAf += 1
-			continue
-		}
 
-		ary := strings.Split(sAf.Text(), ",")
-		if len(ary) != 7 {
-			return nil, fmt.Errorf("ファイルリストのフォーマット不正. len=%d", len(ary))
+		key := strings.ToLower(p)
+		h, ok := m[key]
+		if !ok {
+			h = make(History, n)
+			m[key] = h
 		}
+		h[i] = &SizeAndDateModified{size, d, tempFileListHash(ary), p}
 
-		// フォルダフラグが "TRUE" の場合はチェック対象外のためスキップする
-		if ary[4] == "TRUE" {
-			skipAf += 1
-			continue
-		}
-
-		// ファイルパスが”で括られているので削除する。 パスの区切りは「/」とする
-		p := filepath.ToSlash(strings.Replace(ary[1], "\"", "", -1))
-		s, _ := strconv.Atoi(ary[3])
-		d, err := time.Parse("2006/01/02 15:04:05", ary[5]+" "+ary[6])
-		if err != nil {
-			d = time.Time{}
-		}
-
-		if v, ok := m[strings.ToLower(p)]; ok {
-			v.SizeOld = s
-			v.DateModifiedOld = d
-			updateAf += 1
-		}
+		add += 1
 	}
 
-	if sAf.Err() != nil {
+	if s.Err() != nil {
 		// non-EOF error.
-		return nil, sAf.Err()
+		return s.Err()
 	}
 
-	// ファイル読み込み結果を出力
-	fmt.Println("◆チェック先ファイル(秘密度前)(DEST_FILE_OLD_PATH)の読み込みを完了しました。")
-	fmt.Printf("　→ファイル読み込み件数 : %d\n", readAf)
-	fmt.Printf("　→更新件数 : %d\n", updateAf)
-	fmt.Printf("　→スキップ件数(ディレクトリ) : %d\n", skipAf)
+	if n > 1 {
+		fmt.Printf("◆チェック先ファイル(DEST_FILE_PATH)(スナップショット%d)の読み込みを完了しました。\n", i+1)
+	} else {
+		fmt.Println("◆チェック先ファイル(DEST_FILE_PATH)の読み込みを完了しました。")
+	}
+	fmt.Printf("　→ファイル読み込み件数 : %d\n", read)
+	fmt.Printf("　→検索用ファイル件数 : %d\n", add)
+	fmt.Printf("　→スキップ件数(ディレクトリ) : %d\n", skip)
 
-	return m, nil
+	return nil
 }
 
 // r で指定されたファイルから、チェック用のマップを生成する。
 // r の1行は次の構成。
-// 0:          1:               2:      3:              4:                                           5:
-// "ファイル名","更新日 更新時刻(YYYY/MM/MM h:mm:dd)","更新者","ファイルサイズ","ファイル区分(フォルダ=Folder、ファイル=File)","格納フォルダのパス"
-func generateDestMapFromSPOFileList(r io.Reader, prifix, sd string) (map[string]*SizeAndDateModified, error) {
-	m := make(map[string]*SizeAndDateModified)
+// 0:          1:               2:      3:              4:                                           5:                  6:
+// "ファイル名","更新日 更新時刻(YYYY/MM/MM h:mm:dd)","更新者","ファイルサイズ","ファイル区分(フォルダ=Folder、ファイル=File)","格納フォルダのパス"[,"QuickXorHash"]
+func generateDestMapFromSPOFileList(r io.Reader, prifix, sd string) (map[string]History, error) {
+	m := make(map[string]History)
 	var read, skip, add uint
 
 	p := modifySourcePathPrifix(prifix)
@@ -547,7 +1226,7 @@ func generateDestMapFromSPOFileList(r io.Reader, prifix, sd string) (map[string]
 		}
 
 		ary := strings.Split(s.Text(), ",")
-		if len(ary) != 6 {
+		if len(ary) != 6 && len(ary) != 7 {
 			return nil, fmt.Errorf("ファイルリストのフォーマット不正. len=%d, line=%s", len(ary), s.Text())
 		}
 
@@ -572,7 +1251,13 @@ func generateDestMapFromSPOFileList(r io.Reader, prifix, sd string) (map[string]
 		d = d.Add(9 * time.Hour) // 9時間加算
 
 		// SPOへアップロードすると大文字に（勝手に）変換される場合があるので、キーは小文字に変換する
-		m[strings.ToLower(path)] = &SizeAndDateModified{size, d, 0, time.Time{}}
+		// ハッシュ値(省略可能)
+		hash := ""
+		if len(ary) == 7 {
+			hash = strings.Replace(ary[6], "\"", "", -1) // "を削除
+		}
+
+		m[strings.ToLower(path)] = History{&SizeAndDateModified{size, d, hash, path}}
 
 		add += 1
 	}
@@ -622,7 +1307,7 @@ func generateSourceFromPJFileList(r io.Reader, prifix, ignore string) <-chan Fil
 			size, _ := strconv.Atoi(ary[4])
 			path := p + strings.Replace(strings.Join(aryP, "/"), "\"", "", -1)
 
-			out <- File{path, size, time.Time{}}
+			out <- File{path, size, time.Time{}, ""}
 			add += 1
 		}
 
@@ -646,8 +1331,8 @@ func generateSourceFromPJFileList(r io.Reader, prifix, ignore string) <-chan Fil
 
 // rで指定されたファイルを1行ずつ読み込み、File のチャネルを生成する。
 // rの1行の構成は次の通り。
-// 0:          1:                  2:               3:            4:                              5:                 6:
-// "ファイル名","ファイルのフルパス","ファイルの拡張子",ファイルサイズ,フォルダフラグ(フォルダの場合TRUE),更新日(YYYY/MM/DD),更新時刻(hh:mm:dd)
+// 0:          1:                  2:               3:            4:                              5:                 6:                 7:
+// "ファイル名","ファイルのフルパス","ファイルの拡張子",ファイルサイズ,フォルダフラグ(フォルダの場合TRUE),更新日(YYYY/MM/DD),更新時刻(hh:mm:dd)[,"ハッシュ値"]
 func generateSourceFromTempFileList(r io.Reader, ignore string) <-chan File {
 	out := make(chan File, 50) // バッファ数50の根拠はなし
 
@@ -673,9 +1358,8 @@ func generateSourceFromTempFileList(r io.Reader, ignore string) <-chan File {
 			// ファイルサイズ
 			size, _ := strconv.Atoi(ary[3])
 
-			// ファイル名が「~$」で始まるファイル、かつ、200バイト未満は対象外のためスキップする
-			// Thumbs.db もスキップする
-			if (strings.HasPrefix(ary[0], `"~$`) && size < 200) || ary[0] == "\"Thumbs.db\"" {
+			// SPOへアップロードされないファイルは対象外のためスキップする
+			if isInvalidFile(strings.Replace(ary[0], "\"", "", -1), size) {
 				invalidSlip += 1
 				continue
 			}
@@ -693,7 +1377,7 @@ func generateSourceFromTempFileList(r io.Reader, ignore string) <-chan File {
 				d = time.Time{}
 			}
 
-			out <- File{p, size, d}
+			out <- File{p, size, d, tempFileListHash(ary)}
 			add += 1
 		}
 
@@ -717,6 +1401,20 @@ func generateSourceFromTempFileList(r io.Reader, ignore string) <-chan File {
 	return out
 }
 
+// ファイル名が「~$」で始まるファイル、かつ、200バイト未満は対象外とする。
+// Thumbs.db も対象外とする。
+func isInvalidFile(name string, size int) bool {
+	return (strings.HasPrefix(name, "~$") && size < 200) || name == "Thumbs.db"
+}
+
+// TEMPのファイルリストの1行を分割した ary から、8列目のハッシュ値を返す。ハッシュ値がない場合は空文字を返す。
+func tempFileListHash(ary []string) string {
+	if len(ary) < 8 {
+		return ""
+	}
+	return strings.Replace(ary[7], "\"", "", -1)
+}
+
 // s の "\" を "/" に置換する。置換した結果、末尾に "/" がない場合は付加する。
 func modifySourcePathPrifix(s string) string {
 	prifix := strings.Replace(s, "\\", "/", -1)
@@ -727,66 +1425,186 @@ func modifySourcePathPrifix(s string) string {
 }
 
 // ワーカー
-func worker(fileCh <-chan File, destMap map[string]*SizeAndDateModified, resultsCh chan<- Unmatch, compareMode int, wg *sync.WaitGroup) {
+func worker(fileCh <-chan File, destMap map[string]History, resultsCh chan<- Unmatch, opts CompareOptions, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	// タスクがなくなってタスクのチェネルがcloseされるまで無限ループ
 	for f := range fileCh {
-		isExist := true
-		msg := ""
-		if v, ok := destMap[strings.ToLower(f.path)]; ok {
-			switch compareMode {
-			case compareModeSizeEq:
-				if v.Size != f.size && v.SizeOld != f.size {
-					isExist = false
-					msg = UnmatchReasonSizeUnmatch
-				}
-			case compareModeSizeGe:
-				if v.Size < f.size {
-					isExist = false
-					msg = UnmatchReasonSizeShrink
-				}
-			case compareModeSizeGeAndModGe:
-				// 比較先のファイルサイズは、比較元のファイルサイズ以上であるのが正しい
-				if v.Size < f.size {
-					// fmt.Printf("比較元サイズ:%d, 比較先サイズ:%d\n", f.size, v.beforeSize)
-					isExist = false
-					msg = UnmatchReasonSizeShrink
-				} else {
-					// 比較先の更新日時は、比較元の更新日時より未来であるのが正しい
-					if v.DateModified.Unix() <= f.dateModified.Unix() {
-						// fmt.Printf("比較元更新日時:%s, 比較先更新日時:%s\n", f.dateModified.Format("2006/01/02 15:04:05"), v.beforeDateModified.Format("2006/01/02 15:04:05"))
-						isExist = false
-						msg = UnmatchReasonDateModifiedError
-					}
-				}
-			}
-		} else {
-			isExist = false
-			msg = UnmatchReasonNonExist
-		}
-
-		if !isExist {
-			resultsCh <- Unmatch{f.path, msg}
+		msg, note := compareDest(f, destMap, opts)
+		if msg != "" {
+			resultsCh <- Unmatch{f.path, msg, note}
 			// fmt.Printf("%s:%s\n", msg, f.path)
 		}
 	}
 }
 
-// w へアンマッチファイルのパスを出力する(goroutineで実行される)
-func writeUnMatchFile(resultsCh <-chan Unmatch, w io.Writer, done chan<- struct{}) error {
-	// 書き出し完了を表すチャネルをクローズする
+// 比較元ファイル f を destMap から検索して opts に従って比較する。
+// 不一致理由(一致する場合は空文字)と備考を返す。
+func compareDest(f File, destMap map[string]History, opts CompareOptions) (string, string) {
+	var notes []string
+
+	// 適用した比較ルール
+	policy := findPolicy(opts.policies, f.path)
+	if policy != nil {
+		notes = append(notes, "policy="+policy.pattern)
+	}
+
+	var h History
+	var ok bool
+	if opts.live != nil {
+		h, ok = opts.live.find(f.path)
+	} else {
+		h, ok = destMap[strings.ToLower(f.path)]
+	}
+	if !ok {
+		return UnmatchReasonNonExist, strings.Join(notes, ";")
+	}
+
+	msg, matched := compareHistory(f, h, opts, policy)
+	if n := snapshotNote(matched, len(h)); n != "" {
+		notes = append([]string{n}, notes...)
+	}
+
+	// サイズ不一致の場合は、メタデータ以外の内容が一致しているか確認する
+	if opts.deep != nil && (msg == UnmatchReasonSizeUnmatch || msg == UnmatchReasonSizeShrink) {
+		// 比較先のフォルダを直接確認する場合は、比較先のフォルダのファイルと比較する
+		dp := f.path
+		if opts.live != nil {
+			dp = opts.live.resolve(f.path)
+		}
+		var n string
+		msg, n = opts.deep.compare(f.path, dp, msg)
+		if n != "" {
+			notes = append(notes, n)
+		}
+	}
+	return msg, strings.Join(notes, ";")
+}
+
+// 比較元ファイル f と比較先ファイルの履歴 h を opts.snapshotMode に従って比較する。
+// 不一致理由(一致する場合は空文字)と、一致したスナップショットの番号(1始まり)を返す。
+func compareHistory(f File, h History, opts CompareOptions, policy *Policy) (string, []int) {
+	var matched []int
+	reasons := make([]string, len(h))
+	for i, v := range h {
+		reasons[i] = UnmatchReasonNonExist
+		if v != nil {
+			reasons[i] = compareSnapshot(f, v, opts, policy)
+		}
+		if reasons[i] == "" {
+			matched = append(matched, i+1)
+		}
+	}
+
+	switch opts.snapshotMode {
+	case snapshotModeLatest:
+		return reasons[len(h)-1], matched
+	case snapshotModeAll:
+		for _, r := range reasons {
+			if r != "" {
+				return r, matched
+			}
+		}
+		return "", matched
+	}
+
+	// snapshotModeAny
+	// 一致しない場合は、最後に存在するスナップショットの不一致理由とする
+	if len(matched) > 0 {
+		return "", matched
+	}
+	for i := len(h) - 1; i >= 0; i-- {
+		if h[i] != nil {
+			return reasons[i], matched
+		}
+	}
+	return UnmatchReasonNonExist, matched
+}
+
+// 一致したスナップショットの番号を備考の形式に変換する。スナップショットが1つの場合は空文字を返す。
+func snapshotNote(matched []int, n int) string {
+	if n <= 1 {
+		return ""
+	}
+	if len(matched) == 0 {
+		return "snapshot=-"
+	}
+	ss := make([]string, len(matched))
+	for i, m := range matched {
+		ss[i] = strconv.Itoa(m)
+	}
+	return "snapshot=" + strings.Join(ss, " ")
+}
+
+// 比較元ファイル f とスナップショット v を比較する。
+// policy が nil でない場合は、opts.compareMode の代わりに policy で比較する。
+func compareSnapshot(f File, v *SizeAndDateModified, opts CompareOptions, policy *Policy) string {
+	// 両方のハッシュ値を比較できる場合は、ハッシュ値のみで判定する
+	if opts.verifyHash {
+		if match, ok := compareHash(f.hash, v.Hash); ok {
+			if match {
+				return ""
+			}
+			return UnmatchReasonHashUnmatch
+		}
+	}
+
+	if policy != nil {
+		return policy.compare(f, v)
+	}
+	return compareFile(f, v, opts.compareMode)
+}
+
+// 比較元ファイル f と比較先ファイル v を compareMode に従って比較する。
+// 一致する場合は空文字、不一致の場合は不一致理由を返す。
+func compareFile(f File, v *SizeAndDateModified, compareMode int) string {
+	switch compareMode {
+	case compareModeSizeEq:
+		if v.Size != f.size {
+			return UnmatchReasonSizeUnmatch
+		}
+	case compareModeSizeGe:
+		if v.Size < f.size {
+			return UnmatchReasonSizeShrink
+		}
+	case compareModeSizeGeAndModGe:
+		// 比較先のファイルサイズは、比較元のファイルサイズ以上であるのが正しい
+		if v.Size < f.size {
+			// fmt.Printf("比較元サイズ:%d, 比較先サイズ:%d\n", f.size, v.beforeSize)
+			return UnmatchReasonSizeShrink
+		}
+		// 比較先の更新日時は、比較元の更新日時より未来であるのが正しい
+		if v.DateModified.Unix() <= f.dateModified.Unix() {
+			// fmt.Printf("比較元更新日時:%s, 比較先更新日時:%s\n", f.dateModified.Format("2006/01/02 15:04:05"), v.beforeDateModified.Format("2006/01/02 15:04:05"))
+			return UnmatchReasonDateModifiedError
+		}
+	}
+	return ""
+}
+
+// w へアンマッチファイルのパスを出力する(goroutineで実行される)
+// 書き込みに失敗した場合も resultsCh がクローズされるまで読み捨て、エラーを errCh へ送信する。
+func writeUnMatchFile(resultsCh <-chan Unmatch, w io.Writer, done chan<- struct{}, errCh chan<- error) (err error) {
+	// 書き出し完了を表すチャネルをクローズする
 	defer close(done)
+	defer func() { errCh <- err }()
 
-	var write, nonexists, sizeunmatch, sizeshrink, dateModified uint
+	var write, nonexists, sizeunmatch, sizeshrink, dateModified, contentUnmatch, metadataOnly, hashUnmatch uint
 
 	bw := bufio.NewWriter(w)
-	defer bw.Flush()
 
 	// resultsCh が close するまで繰り返す
 	for p := range resultsCh {
-		if _, err := bw.WriteString(fmt.Sprintf("%s,%s\n", p.reason, p.path)); err != nil {
-			return err
+		if err != nil {
+			// ワーカーが送信待ちで停止しないように、書き込みに失敗した後も読み捨てる
+			continue
+		}
+		line := fmt.Sprintf("%s,%s", p.reason, p.path)
+		if p.note != "" {
+			line += "," + p.note
+		}
+		if _, err = bw.WriteString(line + "\n"); err != nil {
+			continue
 		}
 		write += 1
 		switch p.reason {
@@ -798,8 +1616,20 @@ func writeUnMatchFile(resultsCh <-chan Unmatch, w io.Writer, done chan<- struct{
 			sizeshrink += 1
 		case UnmatchReasonDateModifiedError:
 			dateModified += 1
+		case UnmatchReasonContentUnmatch:
+			contentUnmatch += 1
+		case UnmatchReasonMetadataOnly:
+			metadataOnly += 1
+		case UnmatchReasonHashUnmatch:
+			hashUnmatch += 1
 		}
 	}
+	if err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
 
 	// 結果を出力
 	fmt.Println("◆結果ファイル(OUTPUT_FILE_PATH)の書き込みを完了しました。")
@@ -808,6 +1638,9 @@ func writeUnMatchFile(resultsCh <-chan Unmatch, w io.Writer, done chan<- struct{
 	fmt.Printf("　→サイズ不一致 : %d\n", sizeunmatch)
 	fmt.Printf("　→サイズ縮小 : %d\n", sizeshrink)
 	fmt.Printf("　→更新日時エラー : %d\n", dateModified)
+	fmt.Printf("　→内容不一致 : %d\n", contentUnmatch)
+	fmt.Printf("　→メタデータのみ変更 : %d\n", metadataOnly)
+	fmt.Printf("　→ハッシュ不一致 : %d\n", hashUnmatch)
 
 	return nil
 }
@@ -824,24 +1657,45 @@ func newBufioReader(r io.Reader) *bufio.Reader {
 	return br
 }
 
-func writeFilePathList(filepathCh <-chan string, outfile string, done chan<- struct{}, verbose int) error {
+// ファイルリストの出力データ
+type listRow struct {
+	line       string     // 出力する行
+	checkpoint chan int64 // 指定した場合は行を出力せず、それまでの行を書き出してファイルのサイズを返す
+}
+
+// outfile へファイルリストを出力する(goroutineで実行される)
+// 再開する場合は cp の時点の位置から追記する。
+// 出力に失敗した場合は、以降の行を受け取らずに終了する。エラーは errCh へ送信する。
+func writeFilePathList(filepathCh <-chan listRow, outfile string, cp *checkpoint, done chan<- struct{}, errCh chan<- error, verbose int) (err error) {
 	// 書き出し完了を表すチャネルをクローズする
 	defer close(done)
+	defer func() { errCh <- err }()
 
 	count := 0
 
-	outFp, err := os.OpenFile(outfile, os.O_CREATE|os.O_TRUNC, 0644)
+	outFp, err := openResumableFile(outfile, cp.resumed, cp.listOffset)
 	if err != nil {
 		return err
 	}
 	defer outFp.Close()
 
 	bw := bufio.NewWriter(outFp)
-	defer bw.Flush()
 
 	// resultsCh が close するまで繰り返す
 	for p := range filepathCh {
-		if _, err := bw.WriteString(fmt.Sprintf("%s\n", p)); err != nil {
+		if p.checkpoint != nil {
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+			offset, err := outFp.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			p.checkpoint <- offset
+			continue
+		}
+
+		if _, err := bw.WriteString(fmt.Sprintf("%s\n", p.line)); err != nil {
 			return err
 		}
 		count += 1
@@ -850,6 +1704,9 @@ func writeFilePathList(filepathCh <-chan string, outfile string, done chan<- str
 		}
 
 	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
 
 	// 結果を出力
 	fmt.Println("◆ファイルリストの出力を完了しました。")
@@ -878,6 +1735,15 @@ func opsBaseDir(b *string) *cli.StringFlag {
 
 }
 
+func opsBaseDirNonRequired(b *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "baseDir",
+		Aliases:     []string{"b"},
+		Usage:       "チェック先フォルダのパス `BASE_DIR` を指定します。",
+		Destination: b,
+	}
+}
+
 func opsSPODir(b *string) *cli.StringFlag {
 	return &cli.StringFlag{
 		Name:        "spoDir",
@@ -888,6 +1754,43 @@ func opsSPODir(b *string) *cli.StringFlag {
 	}
 }
 
+func opsSPODirNonRequired(b *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "spoDir",
+		Aliases:     []string{"q"},
+		Usage:       "SPOのフォルダパス `SPO_DIR` を指定します。",
+		Destination: b,
+	}
+}
+
+func opsListFormat(f *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "format",
+		Aliases:     []string{"f"},
+		Usage:       "ファイルリストの形式 `FORMAT` (temp, spo, pweb)を指定します。SOURCE_FILE_PATH に旧、DEST_FILE_PATH に新のファイルリストを指定します。",
+		Value:       listFormatTemp,
+		Destination: f,
+	}
+}
+
+func opsDeleted(d *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "deleted",
+		Aliases:     []string{"D"},
+		Usage:       "削除されたファイルを出力するファイルのパス `DELETED_FILE_PATH` を指定します。未指定の場合、OUTPUT_FILE_PATH に「.deleted」を付加したパスとなります。",
+		Destination: d,
+	}
+}
+
+func opsRollup(r *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "rollup",
+		Aliases:     []string{"r"},
+		Usage:       "フォルダごとの集計を出力するファイルのパス `ROLLUP_FILE_PATH` を指定します。未指定の場合、OUTPUT_FILE_PATH に「.folders」を付加したパスとなります。",
+		Destination: r,
+	}
+}
+
 func opsSource(s *string) *cli.StringFlag {
 	return &cli.StringFlag{
 		Name:        "source",
@@ -898,6 +1801,15 @@ func opsSource(s *string) *cli.StringFlag {
 	}
 }
 
+func opsSourceNonRequired(s *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "source",
+		Aliases:     []string{"s"},
+		Usage:       "比較元ファルのパス `SOURCE_FILE_PATH` を指定します。",
+		Destination: s,
+	}
+}
+
 func opsDest(d *string) *cli.StringFlag {
 	return &cli.StringFlag{
 		Name:        "dest",
@@ -908,6 +1820,47 @@ func opsDest(d *string) *cli.StringFlag {
 	}
 }
 
+// 指定された値をそのまま追加するパスのリスト
+// cli.StringSlice は値をカンマで分割する場合があるため、カンマを含むパスを指定できない。
+type pathList []string
+
+// エイリアス間で値をコピーする際に、直列化した値であることを示す接頭辞
+const pathListPrefix = "pathlist:::"
+
+func (p *pathList) Set(v string) error {
+	// 直列化した値の場合は置き換える
+	if strings.HasPrefix(v, pathListPrefix) {
+		return json.Unmarshal([]byte(v[len(pathListPrefix):]), p)
+	}
+	*p = append(*p, v)
+	return nil
+}
+
+// エイリアス間で値をコピーするために、値を直列化する(cli.Serializer)。
+func (p *pathList) Serialize() string {
+	b, _ := json.Marshal([]string(*p))
+	return pathListPrefix + string(b)
+}
+
+func (p *pathList) String() string {
+	return strings.Join(*p, ", ")
+}
+
+// 指定されたパスを指定順に返す。
+func (p *pathList) Value() []string {
+	return *p
+}
+
+func opsDests(d *pathList) *cli.GenericFlag {
+	return &cli.GenericFlag{
+		Name:     "dest",
+		Aliases:  []string{"d"},
+		Usage:    "比較先ファルのパス `DEST_FILE_PATH` を指定します。複数指定した場合、指定順にスナップショットとして扱います。アーカイブ(.tar, .tar.gz, .tgz, .zip)やフォルダも指定できます。",
+		Value:    d,
+		Required: true,
+	}
+}
+
 func opsDestNonRequired(d *string) *cli.StringFlag {
 	return &cli.StringFlag{
 		Name:        "dest",
@@ -925,6 +1878,216 @@ func opsDestOld(d *string) *cli.StringFlag {
 	}
 }
 
+func opsSPOList(s *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "spo",
+		Aliases:     []string{"S"},
+		Usage:       "SPOのファイルリストのパス `SPO_FILE_PATH` を指定します。",
+		Destination: s,
+		Required:    true,
+	}
+}
+
+func opsSnapshotMode(m *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "snapshot-mode",
+		Aliases:     []string{"m"},
+		Usage:       "比較先ファイルのスナップショットとの一致条件 `SNAPSHOT_MODE` (any:いずれか, latest:最新, all:すべて)を指定します。",
+		Value:       "any",
+		Destination: m,
+	}
+}
+
+func opsSPOPolicy(p *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "policy",
+		Aliases:     []string{"P"},
+		Usage:       "拡張子ごとの比較ルールを記載したファイルのパス `POLICY_FILE_PATH` を指定します。比較ルールは TEMP → SPO の段階のみに適用します。",
+		Destination: p,
+	}
+}
+
+func opsPolicy(p *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "policy",
+		Aliases:     []string{"P"},
+		Usage:       "拡張子ごとの比較ルールを記載したファイルのパス `POLICY_FILE_PATH` を指定します。",
+		Destination: p,
+	}
+}
+
+func opsCopySourceDir(s *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "sourceDir",
+		Aliases:     []string{"D"},
+		Usage:       "コピー元となる比較元ファイルの格納フォルダ `SOURCE_DIR` を指定します。check-temp の SOURCE_DIR と同じ構成のフォルダを指定します。",
+		Destination: s,
+		Required:    true,
+	}
+}
+
+func opsSourceDir(s *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "sourceDir",
+		Aliases:     []string{"D"},
+		Usage:       "比較元ファイルの格納フォルダ `SOURCE_DIR` を指定します。指定した場合、サイズ不一致の Office ドキュメントの内容を比較します。",
+		Destination: s,
+	}
+}
+
+func opsHash(h *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "hash",
+		Aliases:     []string{"H"},
+		Usage:       "ファイルのハッシュ値を計算するアルゴリズム `HASH` (quickxor, sha1, sha256)を指定します。",
+		Destination: h,
+	}
+}
+
+func opsColumns(c *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "columns",
+		Aliases:     []string{"C"},
+		Usage:       "追加で出力する列 `COLUMNS` をカンマ区切りで指定します(ext, mtime-ns, ctime, inode, mode, owner, symlink, nlink)。",
+		Destination: c,
+	}
+}
+
+func opsContinueOnError(c *bool) *cli.BoolFlag {
+	return &cli.BoolFlag{
+		Name:        "continue-on-error",
+		Aliases:     []string{"k"},
+		Usage:       "読み込めないフォルダやファイルがあっても処理を継続します。読み込めなかったパスはエラーファイルに出力します。",
+		Destination: c,
+	}
+}
+
+func opsErrors(e *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "errors",
+		Aliases:     []string{"e"},
+		Usage:       "読み込めなかったパスを出力するファイルのパス `ERRORS_FILE_PATH` を指定します。未指定の場合、OUTPUT_FILE_PATH に「.errors」を付加したパスとなります。",
+		Destination: e,
+	}
+}
+
+func opsExclude(e *cli.StringSlice) *cli.StringSliceFlag {
+	return &cli.StringSliceFlag{
+		Name:        "exclude",
+		Aliases:     []string{"x"},
+		Usage:       "探索しないフォルダ名のパターン `EXCLUDE` (例: .snapshot, ~snapshot, $RECYCLE.BIN)を指定します。複数指定できます。",
+		Destination: e,
+	}
+}
+
+func opsMaxDepth(d *int) *cli.IntFlag {
+	return &cli.IntFlag{
+		Name:        "max-depth",
+		Aliases:     []string{"n"},
+		Usage:       "探索する階層の深さ `MAX_DEPTH` を指定します。未指定の場合、すべての階層を探索します。",
+		Destination: d,
+	}
+}
+
+func opsOneFileSystem(x *bool) *cli.BoolFlag {
+	return &cli.BoolFlag{
+		Name:        "one-file-system",
+		Aliases:     []string{"X"},
+		Usage:       "BASE_DIR と異なるファイルシステムのフォルダを探索しません。",
+		Destination: x,
+	}
+}
+
+func opsFollowSymlinks(l *bool) *cli.BoolFlag {
+	return &cli.BoolFlag{
+		Name:        "follow-symlinks",
+		Aliases:     []string{"L"},
+		Usage:       "シンボリックリンクのリンク先を探索します。未指定の場合、シンボリックリンク自体を出力します。",
+		Destination: l,
+	}
+}
+
+func opsWalkConcurrent(w *int) *cli.IntFlag {
+	return &cli.IntFlag{
+		Name:        "walk-concurrent",
+		Aliases:     []string{"w"},
+		Usage:       "フォルダを並行して探索する数 `WALK_CONCURRENT` を指定します。未指定の場合、CPU数(最小4)が設定されます。",
+		Destination: w,
+	}
+}
+
+func opsMaxFilesPerSec(f *int) *cli.IntFlag {
+	return &cli.IntFlag{
+		Name:        "max-files-per-sec",
+		Aliases:     []string{"F"},
+		Usage:       "1秒あたりに処理するファイル(フォルダを含む)の最大数 `MAX_FILES` を指定します。未指定の場合、制限しません。",
+		Destination: f,
+	}
+}
+
+func opsMaxBytesPerSec(b *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "max-bytes-per-sec",
+		Aliases:     []string{"B"},
+		Usage:       "ハッシュ値の計算で1秒あたりに読み込む最大バイト数 `MAX_BYTES` を指定します(K, M, G の単位を付加できます。例: 20M)。未指定の場合、制限しません。",
+		Destination: b,
+	}
+}
+
+func opsSchedule(s *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "schedule",
+		Aliases:     []string{"s"},
+		Usage:       "探索を許可する時間帯 `SCHEDULE` を「HH:MM-HH:MM」形式で指定します(例: 20:00-07:00)。時間帯外は探索を一時停止します。",
+		Destination: s,
+	}
+}
+
+func opsDestStat(s *bool) *cli.BoolFlag {
+	return &cli.BoolFlag{
+		Name:        "dest-stat",
+		Aliases:     []string{"T"},
+		Usage:       "比較先(DEST_FILE_PATH)に指定したフォルダを探索せず、比較元ファイルごとに直接確認します。",
+		Destination: s,
+	}
+}
+
+func opsArchiveBase(a *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "archive-base",
+		Aliases:     []string{"A"},
+		Usage:       "アーカイブ(.tar, .tar.gz, .tgz, .zip)内のエントリを配置するフォルダのパス `ARCHIVE_BASE` を指定します。未指定の場合、アーカイブのパスから拡張子を除いたパスとなります。",
+		Destination: a,
+	}
+}
+
+func opsCheckpoint(c *bool) *cli.BoolFlag {
+	return &cli.BoolFlag{
+		Name:        "checkpoint",
+		Aliases:     []string{"K"},
+		Usage:       "BASE_DIR 直下のフォルダごとに、探索の完了をチェックポイントファイル(OUTPUT_FILE_PATH に「.checkpoint」を付加したパス)に記録します。",
+		Destination: c,
+	}
+}
+
+func opsResume(r *bool) *cli.BoolFlag {
+	return &cli.BoolFlag{
+		Name:        "resume",
+		Aliases:     []string{"R"},
+		Usage:       "チェックポイントファイルから、中断したファイルリストの作成を再開します。",
+		Destination: r,
+	}
+}
+
+func opsVerifyHash(v *bool) *cli.BoolFlag {
+	return &cli.BoolFlag{
+		Name:        "verify-hash",
+		Aliases:     []string{"H"},
+		Usage:       "比較元と比較先の両方にハッシュ値がある場合、サイズと更新日時の代わりにハッシュ値で比較します。",
+		Destination: v,
+	}
+}
+
 func opsOutput(o *string) *cli.StringFlag {
 	return &cli.StringFlag{
 		Name:        "output",
@@ -935,6 +2098,34 @@ func opsOutput(o *string) *cli.StringFlag {
 	}
 }
 
+func opsUnmatch(u *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "unmatch",
+		Aliases:     []string{"u"},
+		Usage:       "チェック結果ファイルのパス `UNMATCH_FILE_PATH` を指定します。",
+		Destination: u,
+		Required:    true,
+	}
+}
+
+func opsResolved(r *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "resolved",
+		Aliases:     []string{"O"},
+		Usage:       "解消した行を出力するファイルのパス `RESOLVED_FILE_PATH` を指定します。未指定の場合、OUTPUT_FILE_PATH に「.resolved」を付加したパスとなります。",
+		Destination: r,
+	}
+}
+
+func opsDefaultStage(s *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "stage",
+		Aliases:     []string{"t"},
+		Usage:       "段階の列がない行(check-temp, check-spo の結果)の段階 `STAGE` を指定します(TEMP, SPO)。未指定の場合、段階の列がない行は再確認せず未解消とします。",
+		Destination: s,
+	}
+}
+
 func opsIgnore(g *string) *cli.StringFlag {
 	return &cli.StringFlag{
 		Name:        "ignore",
@@ -948,12 +2139,39 @@ func opsRecovery(r *string) *cli.StringFlag {
 	return &cli.StringFlag{
 		Name:        "recovery",
 		Aliases:     []string{"r"},
-		Usage:       "SPOへの再送信対象ファイルのリストののパス `RECOVERY_FILE_PATH` を指定します。",
+		Usage:       "SPOへの再送信対象ファイルのリスト(チェック結果ファイル)のパス `RECOVERY_FILE_PATH` を指定します。",
 		Destination: r,
 		Required:    true,
 	}
 }
 
+func opsIncludeReason(i *cli.StringSlice) *cli.StringSliceFlag {
+	return &cli.StringSliceFlag{
+		Name:        "include-reason",
+		Aliases:     []string{"i"},
+		Usage:       "再送信対象とする不一致理由 `REASON` (例: ファイルなし)を指定します。複数指定できます。未指定の場合、すべての不一致理由を対象とします。",
+		Destination: i,
+	}
+}
+
+func opsExcludeReason(e *cli.StringSlice) *cli.StringSliceFlag {
+	return &cli.StringSliceFlag{
+		Name:        "exclude-reason",
+		Aliases:     []string{"e"},
+		Usage:       "再送信対象としない不一致理由 `REASON` (例: ファイル更新日時エラー)を指定します。複数指定できます。",
+		Destination: e,
+	}
+}
+
+func opsSkipped(s *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "skipped",
+		Aliases:     []string{"S"},
+		Usage:       "再送信対象としなかった行とその理由を出力するファイルのパス `SKIPPED_FILE_PATH` を指定します。未指定の場合、OUTPUT_FILE_PATH に「.skipped」を付加したファイル名となります。",
+		Destination: s,
+	}
+}
+
 func opsSpopath(s *string) *cli.StringFlag {
 	return &cli.StringFlag{
 		Name:        "spopath",
@@ -963,6 +2181,224 @@ func opsSpopath(s *string) *cli.StringFlag {
 	}
 }
 
+func opsBackend(b *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "backend",
+		Aliases:     []string{"b"},
+		Usage:       "再送信スクリプトの出力形式 `BACKEND` (pnp: PnP PowerShell, m365: CLI for Microsoft 365, rclone: rclone のファイルリスト, graph: Microsoft Graph のバッチリクエスト)を指定します。",
+		Value:       recoveryBackendPnP,
+		Destination: b,
+	}
+}
+
+func opsTempBackend(b *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "backend",
+		Aliases:     []string{"k"},
+		Usage:       "再コピースクリプトの出力形式 `BACKEND` (robocopy: robocopy のバッチファイル, rsync: rsync のシェルスクリプト)を指定します。",
+		Value:       tempBackendRobocopy,
+		Destination: b,
+	}
+}
+
+func opsSiteURL(s *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "site-url",
+		Aliases:     []string{"u"},
+		Usage:       "接続するSPOのサイトのURL `SITE_URL` を指定します。pnp の場合、未指定であれば接続済みとして Connect-PnPOnline を出力しません。m365 の場合は必須です。",
+		Destination: s,
+	}
+}
+
+func opsLibrary(l *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "library",
+		Aliases:     []string{"l"},
+		Usage:       "アップロード先のライブラリのサイト相対パス `LIBRARY` をエンコードせずに指定します(例: ドキュメント)。",
+		Value:       "Shared Documents",
+		Destination: l,
+	}
+}
+
+func opsRemote(r *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "remote",
+		Aliases:     []string{"R"},
+		Usage:       "rclone の場合に、送信先のライブラリ(ドライブ)を設定した rclone のリモート名 `REMOTE` を指定します。リモートのルートをライブラリのルートとして送信先を生成します。",
+		Value:       "spo",
+		Destination: r,
+	}
+}
+
+func opsDriveID(d *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "drive-id",
+		Aliases:     []string{"D"},
+		Usage:       "graph の場合、または Microsoft Graph を使用する場合に、ライブラリのドライブID `DRIVE_ID` を指定します。",
+		Destination: d,
+	}
+}
+
+func opsExecute(x *bool) *cli.BoolFlag {
+	return &cli.BoolFlag{
+		Name:        "execute",
+		Aliases:     []string{"x"},
+		Usage:       "再送信スクリプトを出力せずに、Microsoft Graph でSPOへのアップロードを実行します。OUTPUT_FILE_PATH にはアップロードの結果を出力します。",
+		Destination: x,
+	}
+}
+
+func opsGraphEndpoint(g *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "graph-endpoint",
+		Aliases:     []string{"E"},
+		Usage:       "Microsoft Graph を使用する場合に、Microsoft Graph のエンドポイント `GRAPH_ENDPOINT` を指定します。",
+		Value:       defaultGraphEndpoint,
+		Destination: g,
+	}
+}
+
+func opsGraphToken(t *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "token",
+		Aliases:     []string{"a"},
+		Usage:       "Microsoft Graph を使用する場合に、Microsoft Graph のアクセストークン `GRAPH_TOKEN` を指定します。未指定の場合、環境変数 GRAPH_TOKEN を使用します。",
+		EnvVars:     []string{"GRAPH_TOKEN"},
+		Destination: t,
+	}
+}
+
+func opsGraphState(g *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "graph-state",
+		Aliases:     []string{"G"},
+		Usage:       "Microsoft Graph の差分クエリの状態ファイルのパス `GRAPH_STATE_FILE_PATH` を指定します。指定した場合、DEST_FILE_PATH の代わりに Microsoft Graph でライブラリのファイルを取得し、前回からの差分を状態ファイルに保存します。SPO_DIR にはライブラリからの相対パスを指定します。",
+		Destination: g,
+	}
+}
+
+func opsState(s *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "state",
+		Aliases:     []string{"s"},
+		Usage:       "アップロードを再開するための状態ファイルのパス `STATE_FILE_PATH` を指定します。未指定の場合、OUTPUT_FILE_PATH に「.state」を付加したファイル名となります。",
+		Destination: s,
+	}
+}
+
+func opsCycleState(s *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "state",
+		Aliases:     []string{"s"},
+		Usage:       "リカバリサイクルの状態ファイルのパス `STATE_FILE_PATH` を指定します。ファイルが存在しない場合、最初の世代として作成します。",
+		Destination: s,
+		Required:    true,
+	}
+}
+
+func opsMaxAttempts(m *int) *cli.IntFlag {
+	return &cli.IntFlag{
+		Name:        "max-attempts",
+		Aliases:     []string{"m"},
+		Usage:       "再送信しても解消しないファイルをエスカレーションとする再送信回数 `MAX_ATTEMPTS` を指定します。",
+		Value:       3,
+		Destination: m,
+	}
+}
+
+func opsEscalation(e *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "escalation",
+		Aliases:     []string{"X"},
+		Usage:       "エスカレーションの対象を出力するファイルのパス `ESCALATION_FILE_PATH` を指定します。未指定の場合、OUTPUT_FILE_PATH に「.escalation」を付加したファイル名となります。",
+		Destination: e,
+	}
+}
+
+func opsAllowEmpty(a *bool) *cli.BoolFlag {
+	return &cli.BoolFlag{
+		Name:        "allow-empty",
+		Aliases:     []string{"z"},
+		Usage:       "チェック結果ファイルに不一致の行がない場合も、未解消のファイルをすべて解消として記録します。",
+		Destination: a,
+	}
+}
+
+func opsReport(r *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "report",
+		Aliases:     []string{"R"},
+		Usage:       "すべてのファイルの判定結果を出力するファイルのパス `REPORT_FILE_PATH` を指定します。未指定の場合、OUTPUT_FILE_PATH に「.report」を付加したファイル名となります。",
+		Destination: r,
+	}
+}
+
+func opsMaxRetries(m *int) *cli.IntFlag {
+	return &cli.IntFlag{
+		Name:        "max-retries",
+		Aliases:     []string{"M"},
+		Usage:       "通信エラーやスロットリング(429)の場合に再試行する回数 `MAX_RETRIES` を指定します。",
+		Value:       5,
+		Destination: m,
+	}
+}
+
+func opsTemplate(t *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "template",
+		Aliases:     []string{"T"},
+		Usage:       "pnp と m365 の場合に、再送信スクリプトのテンプレート(text/template形式)のパス `TEMPLATE_FILE_PATH` を指定します。未指定の場合、既定のテンプレートを使用します。",
+		Destination: t,
+	}
+}
+
+func opsLog(l *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "log",
+		Aliases:     []string{"L"},
+		Usage:       "再送信スクリプトが送信結果を記録するCSVファイルのパス `LOG_FILE_PATH` を指定します。未指定の場合、OUTPUT_FILE_PATH の拡張子を「.log.csv」に置き換えたファイル名となります。",
+		Destination: l,
+	}
+}
+
+func opsCreateFolders(c *bool) *cli.BoolFlag {
+	return &cli.BoolFlag{
+		Name:        "create-folders",
+		Aliases:     []string{"F"},
+		Usage:       "ファイルの送信前に、送信先フォルダを作成するコマンド(Resolve-PnPFolder)を出力します。pnp の場合のみ有効です。",
+		Destination: c,
+	}
+}
+
+func opsShards(n *int) *cli.IntFlag {
+	return &cli.IntFlag{
+		Name:        "shards",
+		Aliases:     []string{"n"},
+		Usage:       "再送信スクリプトを `SHARDS` 個に分割して出力します。同じフォルダのファイルは同じスクリプトに出力します。",
+		Value:       1,
+		Destination: n,
+	}
+}
+
+func opsShardBy(s *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "shard-by",
+		Aliases:     []string{"m"},
+		Usage:       "再送信スクリプトを分割する基準 `SHARD_BY` (bytes: ファイルサイズの合計, count: ファイル数)を指定します。",
+		Value:       shardByBytes,
+		Destination: s,
+	}
+}
+
+func opsSizeList(d *string) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "dest",
+		Aliases:     []string{"d"},
+		Usage:       "ファイルサイズを取得するTEMPのファイルリストのパス `DEST_FILE_PATH` を指定します。",
+		Destination: d,
+	}
+}
+
 func opsTrimWord(t *string) *cli.StringFlag {
 	return &cli.StringFlag{
 		Name:        "trim",
@@ -972,31 +2408,20 @@ func opsTrimWord(t *string) *cli.StringFlag {
 	}
 }
 
-func generateDestMapFromTempFileListPath(pathBefore, pathAfter string) (map[string]*SizeAndDateModified, error) {
-	// チェック先(処理前)のファイル
-	destBeFp, err := os.Open(pathBefore)
-	if err != nil {
-		return nil, err
-	}
-	defer destBeFp.Close()
-
-	// チェック先ファイルからチェック用のハッシュマップを生成する
-	destMap, err := generateDestMapFromTempFileList(destBeFp)
-	if err != nil {
-		return nil, err
-	}
+// paths で指定されたファイルを、指定順のスナップショットとしてチェック用のマップを生成する。
+// アーカイブのファイルは、archiveBase 配下のパスとして読み込む。
+// フォルダの場合は探索し、BASE_DIR(baseDir) 配下のパスとして読み込む。
+func generateDestMapFromTempFileListPath(paths []string, archiveBase, baseDir string) (map[string]History, error) {
+	destMap := make(map[string]History)
 
-	// チェック先(処理後)のファイル
-	if pathAfter != "" {
-		var destOldFp *os.File
-		destOldFp, err := os.Open(pathAfter)
-		if err != nil {
-			return nil, err
+	for i, p := range paths {
+		if isDirPath(p) {
+			if err := generateDestMapFromDir(destMap, p, modifySourcePathPrifix(baseDir), i, len(paths)); err != nil {
+				return nil, err
+			}
+			continue
 		}
-		defer destOldFp.Close()
-
-		destMap, err = updateDestMapFromTempFileList(destMap, destOldFp)
-		if err != nil {
+		if err := generateDestMapFromTempFileListPathAt(destMap, p, archiveBase, i, len(paths)); err != nil {
 			return nil, err
 		}
 	}
@@ -1004,7 +2429,27 @@ func generateDestMapFromTempFileListPath(pathBefore, pathAfter string) (map[stri
 	return destMap, nil
 }
 
-func generateDestMapFromSPOFileListPath(path, prefix, sd string) (map[string]*SizeAndDateModified, error) {
+func generateDestMapFromTempFileListPathAt(m map[string]History, path, archiveBase string, i, n int) error {
+	// チェック先のファイル
+	destFp, err := openTempFileList(path, archiveBase)
+	if err != nil {
+		return err
+	}
+	defer destFp.Close()
+
+	// チェック先ファイルからチェック用のハッシュマップを生成する
+	return generateDestMapFromTempFileList(m, destFp, i, n)
+}
+
+// 比較先ファル(処理後)が指定されている場合は、最後のスナップショットとして追加する。
+func appendDestOld(paths []string, destOld string) []string {
+	if destOld == "" {
+		return paths
+	}
+	return append(paths, destOld)
+}
+
+func generateDestMapFromSPOFileListPath(path, prefix, sd string) (map[string]History, error) {
 	// チェック先のファイル
 	destFp, err := os.Open(path)
 	if err != nil {
@@ -1021,6 +2466,19 @@ func generateDestMapFromSPOFileListPath(path, prefix, sd string) (map[string]*Si
 	return destMap, nil
 }
 
+// SNAPSHOT_MODE の文字列を比較モードに変換する。
+func parseSnapshotMode(s string) (int, error) {
+	switch s {
+	case "", "any":
+		return snapshotModeAny, nil
+	case "latest":
+		return snapshotModeLatest, nil
+	case "all":
+		return snapshotModeAll, nil
+	}
+	return 0, fmt.Errorf("スナップショットの一致条件が不正です. SNAPSHOT_MODE=%s", s)
+}
+
 // NUM_CONCURRENT が未指定の場合は、CPU数の半分とする。
 func getNumConcrent(n int) int {
 	if n > 0 {
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	UnmatchReasonContentUnmatch = "ファイル内容不一致"
+	UnmatchReasonMetadataOnly   = "メタデータのみ変更"
+)
+
+// 内容を比較する Office ドキュメント(OOXML)の拡張子
+var ooxmlExts = map[string]bool{
+	".docx": true, ".docm": true, ".dotx": true, ".dotm": true,
+	".xlsx": true, ".xlsm": true, ".xltx": true, ".xltm": true,
+	".pptx": true, ".pptm": true, ".potx": true, ".potm": true,
+}
+
+// 内容を比較する場合の比較元ファイルの場所
+type DeepCompare struct {
+	basePrefix string // 比較先のファイルパスの先頭部分(BASE_DIR)
+	sourceDir  string // 比較元ファイルの格納フォルダ(SOURCE_DIR)
+}
+
+// 比較先のファイルパス p に対応する比較元ファイルのパスを返す。
+func (d *DeepCompare) sourcePath(p string) string {
+	return modifySourcePathPrifix(d.sourceDir) + strings.TrimPrefix(p, d.basePrefix)
+}
+
+// サイズ不一致となったファイル p の内容を、比較先のパス dp のファイルと比較し、不一致理由と備考を返す。
+// 内容を比較できない場合は msg をそのまま返す。
+func (d *DeepCompare) compare(p, dp, msg string) (string, string) {
+	if !ooxmlExts[strings.ToLower(path.Ext(p))] {
+		return msg, ""
+	}
+
+	metadataOnly, part, err := compareOOXML(d.sourcePath(p), dp)
+	if err != nil {
+		return msg, "deep=" + strings.Replace(err.Error(), ",", " ", -1)
+	}
+	if metadataOnly {
+		return UnmatchReasonMetadataOnly, ""
+	}
+	return UnmatchReasonContentUnmatch, "part=" + part
+}
+
+// OOXML のパーツがメタデータ(文書プロパティ、カスタムXML、秘密度ラベル)の場合 true を返す。
+func isMetadataPart(name string) bool {
+	n := strings.ToLower(strings.TrimPrefix(name, "/"))
+	for strings.HasPrefix(n, "../") {
+		n = strings.TrimPrefix(n, "../")
+	}
+	return strings.HasPrefix(n, "docprops/") ||
+		strings.HasPrefix(n, "customxml/") ||
+		strings.HasPrefix(n, "docmetadata/")
+}
+
+// a と b で指定された OOXML ファイルを、メタデータのパーツを除いて比較する。
+// メタデータ以外のパーツが一致する場合は metadataOnly に true を返す。
+// 一致しない場合は最初に見つかった不一致のパーツ名を返す。
+func compareOOXML(a, b string) (metadataOnly bool, part string, err error) {
+	za, err := zip.OpenReader(a)
+	if err != nil {
+		return false, "", err
+	}
+	defer za.Close()
+
+	zb, err := zip.OpenReader(b)
+	if err != nil {
+		return false, "", err
+	}
+	defer zb.Close()
+
+	pa := ooxmlParts(&za.Reader)
+	pb := ooxmlParts(&zb.Reader)
+
+	names := make([]string, 0, len(pa))
+	for n := range pa {
+		names = append(names, n)
+	}
+	for n := range pb {
+		if _, ok := pa[n]; !ok {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		fa, okA := pa[n]
+		fb, okB := pb[n]
+		if !okA || !okB {
+			return false, n, nil
+		}
+
+		same, err := compareOOXMLPart(n, fa, fb)
+		if err != nil {
+			return false, "", err
+		}
+		if !same {
+			return false, n, nil
+		}
+	}
+
+	return true, "", nil
+}
+
+// メタデータを除いたパーツの一覧を返す。パーツ名は大文字小文字を区別しないため、キーは小文字とする。
+func ooxmlParts(r *zip.Reader) map[string]*zip.File {
+	m := make(map[string]*zip.File)
+	for _, f := range r.File {
+		if strings.HasSuffix(f.Name, "/") || isMetadataPart(f.Name) {
+			continue
+		}
+		m[strings.ToLower(f.Name)] = f
+	}
+	return m
+}
+
+// パーツ name の内容を比較する。
+// リレーションシップとコンテンツタイプはメタデータへの参照を除いて比較し、それ以外は CRC-32 とサイズで比較する。
+func compareOOXMLPart(name string, a, b *zip.File) (bool, error) {
+	var normalize func(io.Reader) (string, error)
+	switch {
+	case strings.HasSuffix(name, ".rels"):
+		normalize = normalizeRelationships
+	case name == "[content_types].xml":
+		normalize = normalizeContentTypes
+	default:
+		return a.CRC32 == b.CRC32 && a.UncompressedSize64 == b.UncompressedSize64, nil
+	}
+
+	na, err := normalizeZipFile(a, normalize)
+	if err != nil {
+		return false, err
+	}
+	nb, err := normalizeZipFile(b, normalize)
+	if err != nil {
+		return false, err
+	}
+	return na == nb, nil
+}
+
+func normalizeZipFile(f *zip.File, normalize func(io.Reader) (string, error)) (string, error) {
+	r, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	s, err := normalize(r)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", f.Name, err)
+	}
+	return s, nil
+}
+
+// メタデータへのリレーションシップを除き、比較用の文字列に変換する。
+// Id は振り直される場合があるため比較しない。
+func normalizeRelationships(r io.Reader) (string, error) {
+	var rels struct {
+		Relationship []struct {
+			Type       string `xml:"Type,attr"`
+			Target     string `xml:"Target,attr"`
+			TargetMode string `xml:"TargetMode,attr"`
+		}
+	}
+	if err := xml.NewDecoder(r).Decode(&rels); err != nil {
+		return "", err
+	}
+
+	var ss []string
+	for _, v := range rels.Relationship {
+		if v.TargetMode != "External" && isMetadataPart(v.Target) {
+			continue
+		}
+		ss = append(ss, v.Type+"|"+v.Target+"|"+v.TargetMode)
+	}
+	sort.Strings(ss)
+	return strings.Join(ss, "\n"), nil
+}
+
+// メタデータのパーツの定義を除き、比較用の文字列に変換する。
+func normalizeContentTypes(r io.Reader) (string, error) {
+	var types struct {
+		Default []struct {
+			Extension   string `xml:"Extension,attr"`
+			ContentType string `xml:"ContentType,attr"`
+		}
+		Override []struct {
+			PartName    string `xml:"PartName,attr"`
+			ContentType string `xml:"ContentType,attr"`
+		}
+	}
+	if err := xml.NewDecoder(r).Decode(&types); err != nil {
+		return "", err
+	}
+
+	var ss []string
+	for _, v := range types.Default {
+		ss = append(ss, "D|"+strings.ToLower(v.Extension)+"|"+v.ContentType)
+	}
+	for _, v := range types.Override {
+		if isMetadataPart(v.PartName) {
+			continue
+		}
+		ss = append(ss, "O|"+strings.ToLower(v.PartName)+"|"+v.ContentType)
+	}
+	sort.Strings(ss)
+	return strings.Join(ss, "\n"), nil
+}
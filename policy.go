@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	policySizeEq  = iota // 許容差の範囲でサイズ一致
+	policySizeGe         // 許容差の範囲でサイズ以上
+	policySizeAny        // サイズは比較しない
+)
+
+const (
+	policyDateGt     = iota // 比較先の更新日時が未来
+	policyDateGe            // 比較先の更新日時が同じか未来
+	policyDateEq            // 更新日時が一致
+	policyDateIgnore        // 更新日時は比較しない
+)
+
+// 拡張子またはファイル名のパターンごとの比較ルール
+type Policy struct {
+	pattern   string  // 拡張子(".pdf")またはファイル名のパターン("*.docx")
+	sizeMode  int     // サイズの比較方法
+	tolerance float64 // サイズの許容差
+	percent   bool    // 許容差が比較元のサイズに対する割合(%)の場合 true
+	dateMode  int     // 更新日時の比較方法
+}
+
+// ファイル名 name がパターンに一致する場合 true を返す。
+func (p *Policy) match(name string) bool {
+	name = strings.ToLower(name)
+	if strings.HasPrefix(p.pattern, ".") {
+		return strings.HasSuffix(name, p.pattern)
+	}
+	ok, _ := path.Match(p.pattern, name)
+	return ok
+}
+
+// 比較元ファイル f と比較先ファイル v をルールに従って比較する。
+// 一致する場合は空文字、不一致の場合は不一致理由を返す。
+// 比較元の更新日時がない場合(P-WEB のファイルリスト)は、更新日時を比較しない。
+func (p *Policy) compare(f File, v *SizeAndDateModified) string {
+	tol := p.tolerance
+	if p.percent {
+		tol = float64(f.size) * p.tolerance / 100
+	}
+
+	diff := float64(v.Size - f.size)
+	switch p.sizeMode {
+	case policySizeEq:
+		if diff > tol || -diff > tol {
+			return UnmatchReasonSizeUnmatch
+		}
+	case policySizeGe:
+		if -diff > tol {
+			return UnmatchReasonSizeShrink
+		}
+	}
+
+	if f.dateModified.IsZero() {
+		return ""
+	}
+
+	switch p.dateMode {
+	case policyDateGt:
+		if v.DateModified.Unix() <= f.dateModified.Unix() {
+			return UnmatchReasonDateModifiedError
+		}
+	case policyDateGe:
+		if v.DateModified.Unix() < f.dateModified.Unix() {
+			return UnmatchReasonDateModifiedError
+		}
+	case policyDateEq:
+		if v.DateModified.Unix() != f.dateModified.Unix() {
+			return UnmatchReasonDateModifiedError
+		}
+	}
+
+	return ""
+}
+
+// ファイルパス p に適用するルールを返す。先頭から順に評価し、最初に一致したルールを適用する。
+// 一致するルールがない場合は nil を返す。
+func findPolicy(policies []*Policy, p string) *Policy {
+	name := path.Base(p)
+	for _, v := range policies {
+		if v.match(name) {
+			return v
+		}
+	}
+	return nil
+}
+
+// r で指定されたファイルから、比較ルールの一覧を生成する。
+// r の1行は次の構成。空行と「#」で始まる行は無視する。
+// パターン,比較モード(eq/ge/any),サイズ許容差(バイト数または「10%」形式),更新日時ルール(gt/ge/eq/ignore)
+func generatePolicies(r io.Reader) ([]*Policy, error) {
+	var policies []*Policy
+
+	s := bufio.NewScanner(newBufioReader(r))
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		ary := strings.Split(text, ",")
+		if len(ary) != 4 {
+			return nil, fmt.Errorf("比較ルールのフォーマット不正. len=%d, line=%d", len(ary), line)
+		}
+		for i := range ary {
+			ary[i] = strings.TrimSpace(ary[i])
+		}
+
+		p := &Policy{pattern: strings.ToLower(ary[0])}
+		if _, err := path.Match(p.pattern, ""); err != nil {
+			return nil, fmt.Errorf("比較ルールのパターンが不正です. pattern=%s, line=%d", ary[0], line)
+		}
+
+		switch ary[1] {
+		case "eq":
+			p.sizeMode = policySizeEq
+		case "ge":
+			p.sizeMode = policySizeGe
+		case "any":
+			p.sizeMode = policySizeAny
+		default:
+			return nil, fmt.Errorf("比較ルールの比較モードが不正です. mode=%s, line=%d", ary[1], line)
+		}
+
+		tol := ary[2]
+		if strings.HasSuffix(tol, "%") {
+			p.percent = true
+			tol = strings.TrimSuffix(tol, "%")
+		}
+		if tol == "" {
+			tol = "0"
+		}
+		t, err := strconv.ParseFloat(tol, 64)
+		if err != nil || t < 0 {
+			return nil, fmt.Errorf("比較ルールのサイズ許容差が不正です. tolerance=%s, line=%d", ary[2], line)
+		}
+		p.tolerance = t
+
+		switch ary[3] {
+		case "gt":
+			p.dateMode = policyDateGt
+		case "ge":
+			p.dateMode = policyDateGe
+		case "eq":
+			p.dateMode = policyDateEq
+		case "ignore":
+			p.dateMode = policyDateIgnore
+		default:
+			return nil, fmt.Errorf("比較ルールの更新日時ルールが不正です. rule=%s, line=%d", ary[3], line)
+		}
+
+		policies = append(policies, p)
+	}
+
+	if s.Err() != nil {
+		// non-EOF error.
+		return nil, s.Err()
+	}
+
+	fmt.Println("◆比較ルールファイル(POLICY_FILE_PATH)の読み込みを完了しました。")
+	fmt.Printf("　→ルール件数 : %d\n", len(policies))
+
+	return policies, nil
+}
+
+// filePath で指定されたファイルから、比較ルールの一覧を生成する。filePath が空の場合は nil を返す。
+func generatePoliciesPath(filePath string) ([]*Policy, error) {
+	if filePath == "" {
+		return nil, nil
+	}
+
+	fp, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	return generatePolicies(fp)
+}
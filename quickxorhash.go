@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash"
+)
+
+// QuickXorHash は OneDrive/SharePoint がファイルごとに公開しているハッシュ値のアルゴリズム。
+// https://docs.microsoft.com/onedrive/developer/code-snippets/quickxorhash
+const (
+	quickXorWidthInBits    = 160
+	quickXorShift          = 11
+	quickXorBitsInLastCell = 32
+	quickXorSize           = (quickXorWidthInBits-1)/8 + 1
+)
+
+type quickXorHash struct {
+	data        [(quickXorWidthInBits-1)/64 + 1]uint64
+	lengthSoFar uint64
+	shiftSoFar  int
+}
+
+// QuickXorHash を計算する hash.Hash を生成する。
+func newQuickXorHash() hash.Hash {
+	return &quickXorHash{}
+}
+
+func (q *quickXorHash) Write(p []byte) (int, error) {
+	currentShift := q.shiftSoFar
+
+	// XOR を開始するビットベクタと、ビットベクタ内の位置
+	vectorArrayIndex := currentShift / 64
+	vectorOffset := currentShift % 64
+
+	iterations := len(p)
+	if iterations > quickXorWidthInBits {
+		iterations = quickXorWidthInBits
+	}
+
+	for i := 0; i < iterations; i++ {
+		isLastCell := vectorArrayIndex == len(q.data)-1
+		bitsInVectorCell := 64
+		if isLastCell {
+			bitsInVectorCell = quickXorBitsInLastCell
+		}
+
+		if vectorOffset <= bitsInVectorCell-8 {
+			for j := i; j < len(p); j += quickXorWidthInBits {
+				q.data[vectorArrayIndex] ^= uint64(p[j]) << uint(vectorOffset)
+			}
+		} else {
+			index1 := vectorArrayIndex
+			index2 := 0
+			if !isLastCell {
+				index2 = vectorArrayIndex + 1
+			}
+			low := uint(bitsInVectorCell - vectorOffset)
+
+			var xoredByte byte
+			for j := i; j < len(p); j += quickXorWidthInBits {
+				xoredByte ^= p[j]
+			}
+			q.data[index1] ^= uint64(xoredByte) << uint(vectorOffset)
+			q.data[index2] ^= uint64(xoredByte) >> low
+		}
+
+		vectorOffset += quickXorShift
+		for vectorOffset >= bitsInVectorCell {
+			if isLastCell {
+				vectorArrayIndex = 0
+			} else {
+				vectorArrayIndex += 1
+			}
+			vectorOffset -= bitsInVectorCell
+		}
+	}
+
+	// 次の開始位置を循環シフトで更新する
+	q.shiftSoFar = (q.shiftSoFar + quickXorShift*(len(p)%quickXorWidthInBits)) % quickXorWidthInBits
+	q.lengthSoFar += uint64(len(p))
+
+	return len(p), nil
+}
+
+func (q *quickXorHash) Sum(b []byte) []byte {
+	var rgb [quickXorSize]byte
+	for i := 0; i < len(q.data)-1; i++ {
+		binary.LittleEndian.PutUint64(rgb[i*8:], q.data[i])
+	}
+	var last [8]byte
+	binary.LittleEndian.PutUint64(last[:], q.data[len(q.data)-1])
+	copy(rgb[(len(q.data)-1)*8:], last[:])
+
+	// ファイルサイズを下位ビットに XOR する
+	var length [8]byte
+	binary.LittleEndian.PutUint64(length[:], q.lengthSoFar)
+	for i := range length {
+		rgb[quickXorWidthInBits/8-len(length)+i] ^= length[i]
+	}
+
+	return append(b, rgb[:]...)
+}
+
+func (q *quickXorHash) Reset() {
+	*q = quickXorHash{}
+}
+
+func (q *quickXorHash) Size() int {
+	return quickXorSize
+}
+
+func (q *quickXorHash) BlockSize() int {
+	return 64
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+// 公開されているテストベクタ(入力と QuickXorHash を Base64 で表したもの)
+// https://github.com/rclone/rclone/blob/master/backend/onedrive/quickxorhash/quickxorhash_test.go
+var quickXorHashVectors = []struct {
+	size int
+	in   string
+	out  string
+}{
+	{0, ``, "AAAAAAAAAAAAAAAAAAAAAAAAAAA="},
+	{1, `Sg==`, "SgAAAAAAAAAAAAAAAQAAAAAAAAA="},
+	{2, `tbQ=`, "taAFAAAAAAAAAAAAAgAAAAAAAAA="},
+	{3, `0pZP`, "0rDEEwAAAAAAAAAAAwAAAAAAAAA="},
+	{12, `h490d57Pqz5q2rtT`, "h3gEHe7giWeswgdq3MYupgAAAAA="},
+	{20, `T6LYJIfDh81JrAK309H2JMJTXis=`, "zBTHrspn3mEcohlJdIUAbjGNaNg="},
+	{21, `DWAAX5/CIfrmErgZa8ot6ZraeSbu`, "LR2Z0PjuRYGKQB/mhQAuMrAGZbQ="},
+	{64, `Mb7EGva2rEE5fENDL85P+BsapHEEjv2/siVhKjvAQe02feExVOQSkfmuYzU/kTF1MaKjPmKF/w+c
+bvwfdWL8aQ==`, "n1anP5NfvD4XDYWIeRPW3ZkPv1Y="},
+	{111, `jyibxJSzO6ZiZ0O1qe3tG/bvIAYssvukh9suIT5wEy1JBINVgPiqdsTW0cOpP0aUfP7mgqLfADkz
+I/m/GgCuVhr8oFLrOCoTx1/psBOWwhltCbhUx51Icm9aH8tY4Z3ccU+6BKpYQkLCy0B/A9Zc`, "hZfLIilSITC6N3e3tQ/iSgEzkto="},
+	{128, `ikwCorI7PKWz17EI50jZCGbV9JU2E8bXVfxNMg5zdmqSZ2NlsQPp0kqYIPjzwTg1MBtfWPg53k0h
+0P2naJNEVgrqpoHTfV2b3pJ4m0zYPTJmUX4Bg/lOxcnCxAYKU29Y5F0U8Quz7ZXFBEweftXxJ7RS
+4r6N7BzJrPsLhY7hgck=`, "imAoFvCWlDn4yVw3/oq1PDbbm6U="},
+	{222, `PfxMcUd0vIW6VbHG/uj/Y0W6qEoKmyBD0nYebEKazKaKG+UaDqBEcmQjbfQeVnVLuodMoPp7P7TR
+1htX5n2VnkHh22xDyoJ8C/ZQKiSNqQfXvh83judf4RVr9exJCud8Uvgip6aVZTaPrJHVjQhMCp/d
+EnGvqg0oN5OVkM2qqAXvA0teKUDhgNM71sDBVBCGXxNOR2bpbD1iM4dnuT0ey4L+loXEHTL0fqMe
+UcEi2asgImnlNakwenDzz0x57aBwyq3AspCFGB1ncX4yYCr/OaCcS5OKi/00WH+wNQU3`, "QX/YEpG0gDsmhEpCdWhsxDzsfVE="},
+	{256, `qwGf2ESubE5jOUHHyc94ORczFYYbc2OmEzo+hBIyzJiNwAzC8PvJqtTzwkWkSslgHFGWQZR2BV5+
+uYTrYT7HVwRM40vqfj0dBgeDENyTenIOL1LHkjtDKoXEnQ0mXAHoJ8PjbNC93zi5TovVRXTNzfGE
+s5dpWVqxUzb5lc7dwkyvOluBw482mQ4xrzYyIY1t+//OrNi1ObGXuUw2jBQOFfJVj2Y6BOyYmfB1
+y36eBxi3zxeG5d5NYjm2GSh6e08QMAwu3zrINcqIzLOuNIiGXBtl7DjKt7b5wqi4oFiRpZsCyx2s
+mhSrdrtK/CkdU6nDN+34vSR/M8rZpWQdBE7a8g==`, "WYT9JY3JIo/pEBp+tIM6Gt2nyTM="},
+	{333, `w0LGhqU1WXFbdavqDE4kAjEzWLGGzmTNikzqnsiXHx2KRReKVTxkv27u3UcEz9+lbMvYl4xFf2Z4
+aE1xRBBNd1Ke5C0zToSaYw5o4B/7X99nKK2/XaUX1byLow2aju2XJl2OpKpJg+tSJ2fmjIJTkfuY
+Uz574dFX6/VXxSxwGH/xQEAKS5TCsBK3CwnuG1p5SAsQq3gGVozDWyjEBcWDMdy8/AIFrj/y03Lf
+c/RNRCQTAfZbnf2QwV7sluw4fH3XJr07UoD0YqN+7XZzidtrwqMY26fpLZnyZjnBEt1FAZWO7RnK
+G5asg8xRk9YaDdedXdQSJAOy6bWEWlABj+tVAigBxavaluUH8LOj+yfCFldJjNLdi90fVHkUD/m4
+Mr5OtmupNMXPwuG3EQlqWUVpQoYpUYKLsk7a5Mvg6UFkiH596y5IbJEVCI1Kb3D1`, "e3+wo77iKcILiZegnzyUNcjCdoQ="},
+}
+
+func TestQuickXorHash(t *testing.T) {
+	for _, tt := range quickXorHashVectors {
+		in, err := base64.StdEncoding.DecodeString(tt.in)
+		if err != nil || len(in) != tt.size {
+			t.Fatalf("テストベクタが不正です. size=%d, %v", tt.size, err)
+		}
+		h := newQuickXorHash()
+		h.Write(in)
+		if got := base64.StdEncoding.EncodeToString(h.Sum(nil)); got != tt.out {
+			t.Errorf("size=%d: QuickXorHash = %s, want %s", tt.size, got, tt.out)
+		}
+	}
+}
+
+// 複数回に分けて Write した場合も、1回で Write した場合と同じ値となる。
+func TestQuickXorHashByBlock(t *testing.T) {
+	for _, blockSize := range []int{1, 7, 64, 159, 160, 161, 200} {
+		for _, tt := range quickXorHashVectors {
+			in, err := base64.StdEncoding.DecodeString(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := newQuickXorHash()
+			for i := 0; i < len(in); i += blockSize {
+				end := i + blockSize
+				if end > len(in) {
+					end = len(in)
+				}
+				if n, err := h.Write(in[i:end]); n != end-i || err != nil {
+					t.Fatalf("Write() = %d, %v", n, err)
+				}
+			}
+			if got := base64.StdEncoding.EncodeToString(h.Sum(nil)); got != tt.out {
+				t.Errorf("size=%d, blockSize=%d: QuickXorHash = %s, want %s", tt.size, blockSize, got, tt.out)
+			}
+		}
+	}
+}
+
+func TestQuickXorHashReset(t *testing.T) {
+	h := newQuickXorHash()
+	h.Write([]byte{1})
+	h.Reset()
+	if got := base64.StdEncoding.EncodeToString(h.Sum(nil)); got != quickXorHashVectors[0].out {
+		t.Errorf("Reset() 後の QuickXorHash = %s, want %s", got, quickXorHashVectors[0].out)
+	}
+	if h.Size() != 20 {
+		t.Errorf("Size() = %d, want 20", h.Size())
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// チェック結果の備考に出力する項目名
+var unmatchNoteKeys = []string{"snapshot=", "policy=", "part=", "deep="}
+
+// チェック結果に出力する不一致理由
+var unmatchReasons = []string{UnmatchReasonNonExist, UnmatchReasonSizeUnmatch, UnmatchReasonSizeShrink, UnmatchReasonDateModifiedError, UnmatchReasonContentUnmatch, UnmatchReasonMetadataOnly, UnmatchReasonHashUnmatch}
+
+// チェック結果ファイルの1行
+type UnmatchRow struct {
+	stage string // check-all の結果の場合は段階(TEMP, SPO)。それ以外は空文字
+	Unmatch
+}
+
+// チェック結果の備考 s が既知の項目名で始まる場合 true を返す。
+func isUnmatchNote(s string) bool {
+	for _, k := range unmatchNoteKeys {
+		if strings.HasPrefix(s, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// チェック結果ファイルの1行 line を解析する。
+// line の構成は次のいずれか。パスにカンマを含む場合も、備考は既知の項目名で判定する。
+// 不一致理由,ファイルパス[,備考]
+// 段階(TEMP, SPO),不一致理由,ファイルパス[,備考]
+func parseUnmatchLine(line string) (UnmatchRow, error) {
+	var row UnmatchRow
+
+	ary := strings.Split(line, ",")
+	if ary[0] == StageTemp || ary[0] == StageSPO {
+		row.stage = ary[0]
+		ary = ary[1:]
+	}
+	if len(ary) < 2 {
+		return row, fmt.Errorf("チェック結果のフォーマット不正. line=%s", line)
+	}
+
+	row.reason = ary[0]
+	ary = ary[1:]
+	if len(ary) > 1 && isUnmatchNote(ary[len(ary)-1]) {
+		row.note = ary[len(ary)-1]
+		ary = ary[:len(ary)-1]
+	}
+	row.path = strings.Join(ary, ",")
+	if row.path == "" {
+		return row, fmt.Errorf("チェック結果のフォーマット不正. line=%s", line)
+	}
+
+	return row, nil
+}
+
+// チェック結果ファイルの1行を生成する。
+func (r UnmatchRow) line() string {
+	s := fmt.Sprintf("%s,%s", r.reason, r.path)
+	if r.stage != "" {
+		s = r.stage + "," + s
+	}
+	if r.note != "" {
+		s += "," + r.note
+	}
+	return s
+}
+
+// r で指定されたチェック結果ファイルを1行ずつ読み込み、UnmatchRow のチャネルを生成する。
+func generateUnmatchRows(r io.Reader) <-chan UnmatchRow {
+	out := make(chan UnmatchRow, 50) // バッファ数50の根拠はなし
+
+	b := newBufioReader(r)
+
+	go func(br *bufio.Reader) {
+		defer close(out)
+
+		var read, skip, add uint
+
+		scanner := bufio.NewScanner(br)
+		for scanner.Scan() {
+			read += 1
+			if scanner.Text() == "" {
+				skip += 1
+				continue
+			}
+
+			row, err := parseUnmatchLine(scanner.Text())
+			if err != nil {
+				fmt.Println(err)
+				skip += 1
+				continue
+			}
+
+			out <- row
+			add += 1
+		}
+
+		// 横着してエラーメッセージの出力のみで終わっている。。。
+		if scanner.Err() != nil {
+			// non-EOF error.
+			fmt.Printf("チェック結果ファイルの読み込みでエラーが発生しました.(%s)\n", scanner.Err())
+			return
+		}
+
+		// ファイル読み込み結果を出力する。
+		fmt.Println("◆チェック結果ファイル(UNMATCH_FILE_PATH)の読み込みを完了しました。")
+		fmt.Printf("　→読み込み件数 : %d\n", read)
+		fmt.Printf("　→スキップ件数 : %d\n", skip)
+		fmt.Printf("　→再確認対象件数 : %d\n", add)
+	}(b)
+
+	return out
+}
+
+// 再確認の結果
+type RecheckResult struct {
+	resolved bool // 解消した場合 true
+	UnmatchRow
+}
+
+// 再確認の条件
+type Recheck struct {
+	sourceMap map[string]File // 比較元ファイル(P-WEB)。nil の場合はファイルの存在のみ確認する
+	stage     string          // 段階の列がない行の段階(TEMP, SPO)。空文字の場合は段階が不明
+	opts      CompareOptions
+}
+
+// チェック結果の1行 row を、現在のファイルの状態で再確認する。
+func (c *Recheck) check(row UnmatchRow) RecheckResult {
+	stage := row.stage
+	if stage == "" {
+		stage = c.stage
+	}
+
+	// SPO の不一致は、ファイルシステムでは確認できないため未解消とする
+	// 段階が不明な場合も、check-spo の結果の可能性があるため未解消とする
+	if stage != StageTemp {
+		return RecheckResult{false, row}
+	}
+
+	f, ok := c.sourceMap[strings.ToLower(row.path)]
+	if !ok {
+		// 比較元のサイズが不明な場合は、ファイルなしのみ存在を確認する
+		if row.reason != UnmatchReasonNonExist {
+			return RecheckResult{false, row}
+		}
+		_, exists := c.opts.live.find(row.path)
+		return RecheckResult{exists, row}
+	}
+
+	msg, note := compareDest(f, nil, c.opts)
+	if msg == "" {
+		return RecheckResult{true, row}
+	}
+	return RecheckResult{false, UnmatchRow{row.stage, Unmatch{row.path, msg, note}}}
+}
+
+// 再確認のワーカー
+func recheckWorker(rowCh <-chan UnmatchRow, c *Recheck, resultsCh chan<- RecheckResult, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for row := range rowCh {
+		resultsCh <- c.check(row)
+	}
+}
+
+// 未解消の行を w へ、解消した行を resolvedW へ出力する(goroutineで実行される)
+func writeRecheckFile(resultsCh <-chan RecheckResult, w, resolvedW io.Writer, done chan<- struct{}) error {
+	// 書き出し完了を表すチャネルをクローズする
+	defer close(done)
+
+	var resolved, failing uint
+	reasons := make(map[string]uint)
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	rbw := bufio.NewWriter(resolvedW)
+	defer rbw.Flush()
+
+	// resultsCh が close するまで繰り返す
+	for r := range resultsCh {
+		out := bw
+		if r.resolved {
+			out = rbw
+			resolved += 1
+		} else {
+			failing += 1
+			reasons[r.reason] += 1
+		}
+		if _, err := out.WriteString(r.line() + "\n"); err != nil {
+			return err
+		}
+	}
+
+	// 結果を出力
+	fmt.Println("◆再確認結果ファイル(OUTPUT_FILE_PATH, RESOLVED_FILE_PATH)の書き込みを完了しました。")
+	fmt.Printf("　→解消件数 : %d\n", resolved)
+	fmt.Printf("　→未解消件数 : %d\n", failing)
+	for _, reason := range unmatchReasons {
+		if reasons[reason] > 0 {
+			fmt.Printf("　　→%s : %d\n", reason, reasons[reason])
+		}
+	}
+
+	return nil
+}
+
+// rで指定された P-WEB のファイルリストから、比較元ファイルのマップを生成する。
+func generateSourceMapFromPJFileList(r io.Reader, prifix string) map[string]File {
+	m := make(map[string]File)
+	for f := range generateSourceFromPJFileList(r, prifix, "") {
+		m[strings.ToLower(f.path)] = f
+	}
+	return m
+}
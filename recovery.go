@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// SPOへの再送信対象ファイル
+type RecoveryItem struct {
+	Path   string // 送信するファイルのパス
+	Folder string // 送信先フォルダのライブラリからの相対パス(先頭は「/」。ライブラリ直下の場合は空文字)
+	Size   int    // ファイルサイズ。不明な場合は 0
+	Base   string // 送信先フォルダ(SPO_PATH 以降)に対応するファイルパスの先頭部分
+	Root   string // 送信先フォルダの先頭部分(SPO_PATH)
+}
+
+// 再送信対象としなかった行の理由
+const (
+	RecoverySkipFormat = "フォーマット不正"
+	RecoverySkipReason = "対象外の不一致理由"
+	RecoverySkipStage  = "TEMPの不一致"
+	RecoverySkipPath   = "フォルダを含まないパス"
+)
+
+// 再送信対象としなかったリカバリリストの行
+type RecoverySkip struct {
+	reason string // 再送信対象としなかった理由
+	line   string // リカバリリストの行
+}
+
+// 再送信対象とする不一致理由の条件
+type ReasonFilter struct {
+	include map[string]bool // 対象とする不一致理由。空の場合はすべての不一致理由を対象とする
+	exclude map[string]bool // 対象としない不一致理由
+}
+
+// 不一致理由 reason がチェック結果に出力する不一致理由の場合 true を返す。
+func isUnmatchReason(reason string) bool {
+	for _, r := range unmatchReasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// include と exclude から ReasonFilter を生成する。不明な不一致理由が含まれる場合はエラーとする。
+func newReasonFilter(include, exclude []string) (*ReasonFilter, error) {
+	f := &ReasonFilter{make(map[string]bool), make(map[string]bool)}
+	for _, v := range []struct {
+		reasons []string
+		m       map[string]bool
+	}{{include, f.include}, {exclude, f.exclude}} {
+		for _, reason := range v.reasons {
+			if !isUnmatchReason(reason) {
+				return nil, fmt.Errorf("不一致理由が不正です. REASON=%s (%s)", reason, strings.Join(unmatchReasons, ", "))
+			}
+			v.m[reason] = true
+		}
+	}
+	return f, nil
+}
+
+// 不一致理由 reason が再送信対象の場合 true を返す。
+func (f *ReasonFilter) match(reason string) bool {
+	if len(f.include) > 0 && !f.include[reason] {
+		return false
+	}
+	return !f.exclude[reason]
+}
+
+// r で指定されたリカバリリスト(チェック結果ファイル)から、再送信対象ファイルを生成する。
+// r の1行は parseUnmatchLine で解析できる形式(check-spo、check-all、recheck の結果)とする。
+// 不一致理由が不明な行(ヘッダ行や diff-list の結果など)、不一致理由が filter の対象外の行、
+// check-all の TEMP の段階の行、フォルダを含まないパスの行は、再送信対象とせずに skips へ追加する。
+// 送信先フォルダは、ファイルパスの最初の「/」以降から trimWord を除き、先頭に spopath を付加したパスとする。
+func generateRecoveryItems(r io.Reader, trimWord, spopath string, filter *ReasonFilter) ([]RecoveryItem, []RecoverySkip, uint, error) {
+	var items []RecoveryItem
+	var skips []RecoverySkip
+	var read uint
+
+	if trimWord != "" && !strings.HasPrefix(trimWord, "/") {
+		trimWord = "/" + trimWord
+	}
+	if spopath != "" && !strings.HasPrefix(spopath, "/") {
+		spopath = "/" + spopath
+	}
+
+	s := bufio.NewScanner(newBufioReader(r))
+	for s.Scan() {
+		read += 1
+		if s.Text() == "" {
+			continue
+		}
+
+		row, err := parseUnmatchLine(s.Text())
+		switch {
+		case err != nil, !isUnmatchReason(row.reason):
+			skips = append(skips, RecoverySkip{RecoverySkipFormat, s.Text()})
+			continue
+		case row.stage == StageTemp:
+			// TEMP の不一致は、TEMP のファイルが正しくないため再送信しない
+			skips = append(skips, RecoverySkip{RecoverySkipStage, s.Text()})
+			continue
+		case !filter.match(row.reason):
+			skips = append(skips, RecoverySkip{RecoverySkipReason, s.Text()})
+			continue
+		}
+
+		filePath := strings.Replace(row.path, "\\", "/", -1)
+		i := strings.Index(filePath, "/")
+		if i < 0 {
+			skips = append(skips, RecoverySkip{RecoverySkipPath, s.Text()})
+			continue
+		}
+		dirPath := filePath[i:strings.LastIndex(filePath, "/")]
+		base := filePath[:i]
+		if trimWord != "" && strings.HasPrefix(dirPath, trimWord) {
+			dirPath = dirPath[len(trimWord):]
+			base += trimWord
+		}
+		if spopath != "" {
+			dirPath = fmt.Sprintf("%s%s", spopath, dirPath)
+		}
+
+		items = append(items, RecoveryItem{filePath, dirPath, 0, base, spopath})
+	}
+
+	if s.Err() != nil {
+		// non-EOF error.
+		return nil, nil, read, s.Err()
+	}
+
+	return items, skips, read, nil
+}
+
+// w へ再送信対象としなかった行を出力し、理由ごとの件数を出力する。1行の構成は次の通り。
+// 理由,リカバリリストの行
+func writeRecoverySkips(skips []RecoverySkip, w io.Writer) error {
+	counts := make(map[string]uint)
+
+	bw := bufio.NewWriter(w)
+	for _, skip := range skips {
+		if _, err := bw.WriteString(skip.reason + "," + skip.line + "\n"); err != nil {
+			return err
+		}
+		counts[skip.reason] += 1
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println("◆スキップファイル(SKIPPED_FILE_PATH)の書き込みを完了しました。")
+	fmt.Printf("　→スキップ件数 : %d\n", len(skips))
+	for _, reason := range []string{RecoverySkipFormat, RecoverySkipReason, RecoverySkipStage, RecoverySkipPath} {
+		if counts[reason] > 0 {
+			fmt.Printf("　　→%s : %d\n", reason, counts[reason])
+		}
+	}
+
+	return nil
+}
+
+// items の送信先フォルダを、重複を除いて階層の浅い順(同じ深さの場合は名前順)に返す。ライブラリ直下は含まない。
+func recoveryFolders(items []RecoveryItem) []string {
+	var folders []string
+	added := make(map[string]bool)
+	for _, item := range items {
+		// SPO はフォルダ名の大文字小文字を区別しない
+		key := strings.ToLower(item.Folder)
+		if item.Folder == "" || added[key] {
+			continue
+		}
+		added[key] = true
+		folders = append(folders, item.Folder)
+	}
+
+	sort.SliceStable(folders, func(i, j int) bool {
+		di, dj := strings.Count(folders[i], "/"), strings.Count(folders[j], "/")
+		if di != dj {
+			return di < dj
+		}
+		return strings.ToLower(folders[i]) < strings.ToLower(folders[j])
+	})
+	return folders
+}
+
+// PowerShell の単一引用符の文字列リテラルに変換する。
+// 単一引用符とみなされる文字(’ ‘ ‚ ‛ を含む)は2つ重ねてエスケープする。
+// 単一引用符の文字列では「$」「`」「"」は展開されないため、エスケープしない。
+func psQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('\'')
+	for _, c := range s {
+		switch c {
+		case '\'', '\u2018', '\u2019', '\u201a', '\u201b':
+			b.WriteRune(c)
+		}
+		b.WriteRune(c)
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
+// SPO のパスで URL エンコードが必要な文字(「%」「#」「 」)をエンコードする。
+var spoPathReplacer = strings.NewReplacer("%", "%25", "#", "%23", " ", "%20")
+
+func spoPathEscape(s string) string {
+	return spoPathReplacer.Replace(s)
+}
+
+// 再送信スクリプトのテンプレートに渡すデータ
+type RecoveryScript struct {
+	SiteURL string         // 接続するサイトのURL。空文字の場合は接続済みとみなす
+	Library string         // ライブラリのサイト相対パス(エンコードしない)
+	LogPath string         // 送信結果を記録するCSVファイルのパス。相対パスの場合はスクリプトの格納フォルダからのパス
+	Output  string         // 出力する再送信スクリプトのパス
+	Items   []RecoveryItem // 再送信対象ファイル
+	Folders []string       // 送信前に作成するフォルダ(ライブラリからの相対パス)。作成しない場合は nil
+}
+
+// ライブラリからの相対パス folder を、送信先フォルダのエンコードしたパスに変換する。
+func (s *RecoveryScript) FolderURL(folder string) string {
+	return spoPathEscape(s.Library + folder)
+}
+
+// 既定の再送信スクリプトのテンプレート
+// ファイルごとに送信結果をCSVファイルに記録し、最後に成功件数と失敗件数を出力する。
+// Resolve-PnPFolder にはエンコードしないパス、Add-PnPFile にはエンコードしたパスを渡す。
+const defaultRecoveryTemplate = `# pjkakuninja recovery-spo で生成したSPOへの再送信スクリプト
+$ErrorActionPreference = "Stop"
+{{- if .SiteURL}}
+Connect-PnPOnline -Url {{ps .SiteURL}} -Interactive
+{{- end}}
+
+$log = {{ps .LogPath}}
+if (-not [System.IO.Path]::IsPathRooted($log)) {
+    $log = Join-Path $PSScriptRoot $log
+}
+"Result,Path,Folder,Message" | Out-File -FilePath $log -Encoding UTF8
+
+$success = 0
+$failure = 0
+
+function Write-RecoveryLog([string]$Result, [string]$Path, [string]$Folder, [string]$Message) {
+    $values = @($Path, $Folder, $Message) | ForEach-Object { '"' + ($_ -replace '"', '""') + '"' }
+    (@($Result) + $values) -join "," | Out-File -FilePath $log -Append -Encoding UTF8
+}
+
+function Resolve-RecoveryFolder([string]$Folder) {
+    try {
+        Resolve-PnPFolder -SiteRelativePath $Folder | Out-Null
+    } catch {
+        Write-RecoveryLog "FolderFailure" "" $Folder $_.Exception.Message
+    }
+}
+
+function Add-RecoveryFile([string]$Path, [string]$Folder) {
+    try {
+        Add-PnPFile -Path $Path -Folder $Folder | Out-Null
+        Write-RecoveryLog "Success" $Path $Folder ""
+        $script:success++
+    } catch {
+        Write-RecoveryLog "Failure" $Path $Folder $_.Exception.Message
+        $script:failure++
+    }
+}
+
+{{range .Folders -}}
+Resolve-RecoveryFolder -Folder {{ps (print $.Library .)}}
+{{end}}
+{{- if .Folders}}
+{{end -}}
+{{range .Items -}}
+Add-RecoveryFile -Path {{ps .Path}} -Folder {{ps ($.FolderURL .Folder)}}
+{{end}}
+Write-Host "成功 : $success 件"
+Write-Host "失敗 : $failure 件"
+Write-Host "送信結果 : $log"
+`
+
+// テンプレートで使用できる関数
+var recoveryTemplateFuncs = template.FuncMap{
+	"ps":  psQuote,       // PowerShell の単一引用符の文字列リテラルに変換する
+	"spo": spoPathEscape, // SPO のパスをエンコードする
+	"sh":  shQuote,       // シェルの単一引用符の文字列リテラルに変換する
+}
+
+// path で指定されたテンプレートを読み込む。path が空文字の場合は既定のテンプレート text を使用する。
+func newRecoveryTemplate(path, text string) (*template.Template, error) {
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		text = string(b)
+	}
+
+	return template.New(filepath.Base(path)).Funcs(recoveryTemplateFuncs).Parse(text)
+}
+
+// 再送信スクリプトの出力形式
+type RecoveryWriter interface {
+	// w へ data の再送信スクリプトを出力する。
+	Write(w io.Writer, data *RecoveryScript) error
+}
+
+// テンプレートから再送信スクリプトを出力する
+type templateRecoveryWriter struct {
+	t   *template.Template
+	bom bool // UTF-8 の BOM を出力する場合 true
+}
+
+// w へ再送信スクリプトを出力する。
+// PowerShell 5.1 で日本語のパスを扱えるように、PowerShell のスクリプトは UTF-8(BOM付き)で出力する。
+func (p *templateRecoveryWriter) Write(w io.Writer, data *RecoveryScript) error {
+	bw := bufio.NewWriter(w)
+	if p.bom {
+		if _, err := bw.WriteString("\ufeff"); err != nil {
+			return err
+		}
+	}
+	if err := p.t.Execute(bw, data); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// スクリプトの分割方法
+const (
+	shardByBytes = "bytes" // ファイルサイズの合計で均等にする
+	shardByCount = "count" // ファイル数で均等にする
+)
+
+// TEMP のファイルリストから生成した destMap から、items のファイルサイズを設定する。
+// ファイルリストにないファイルは 0 とし、その件数を返す。
+func setRecoveryItemSizes(items []RecoveryItem, destMap map[string]History) uint {
+	var unknown uint
+	for i := range items {
+		h, ok := destMap[strings.ToLower(filepath.ToSlash(items[i].Path))]
+		if !ok || h.Latest() == nil {
+			unknown += 1
+			continue
+		}
+		items[i].Size = h.Latest().Size
+	}
+	return unknown
+}
+
+// items を n 個に分割する。同じ送信先フォルダのファイルは同じ分割先とする。
+// フォルダごとの合計(shardBy に従いファイルサイズまたはファイル数)の大きい順に、合計が最も小さい分割先へ割り当てる。
+// 分割先ごとのファイルの順序は items の順序のままとする。
+func shardRecoveryItems(items []RecoveryItem, n int, shardBy string) ([][]RecoveryItem, error) {
+	if shardBy != shardByBytes && shardBy != shardByCount {
+		return nil, fmt.Errorf("スクリプトの分割方法が不正です. SHARD_BY=%s", shardBy)
+	}
+	if n <= 1 {
+		return [][]RecoveryItem{items}, nil
+	}
+
+	// 送信先フォルダごとの合計
+	groupOf := make([]int, len(items))
+	groups := make(map[string]int)
+	var weights []int64
+	for i, item := range items {
+		key := strings.ToLower(item.Folder)
+		g, ok := groups[key]
+		if !ok {
+			g = len(weights)
+			groups[key] = g
+			weights = append(weights, 0)
+		}
+		groupOf[i] = g
+		if shardBy == shardByBytes {
+			weights[g] += int64(item.Size)
+		} else {
+			weights[g] += 1
+		}
+	}
+
+	order := make([]int, len(weights))
+	for g := range order {
+		order[g] = g
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return weights[order[i]] > weights[order[j]]
+	})
+
+	// 合計が最も小さい分割先へ割り当てる。合計が同じ場合は、フォルダ数の少ない分割先とする
+	loads := make([]int64, n)
+	counts := make([]int, n)
+	shardOf := make([]int, len(weights))
+	for _, g := range order {
+		min := 0
+		for s := 1; s < n; s++ {
+			if loads[s] < loads[min] || (loads[s] == loads[min] && counts[s] < counts[min]) {
+				min = s
+			}
+		}
+		shardOf[g] = min
+		loads[min] += weights[g]
+		counts[min] += 1
+	}
+
+	shards := make([][]RecoveryItem, n)
+	for i, item := range items {
+		s := shardOf[groupOf[i]]
+		shards[s] = append(shards[s], item)
+	}
+	return shards, nil
+}
+
+// 分割した i 番目(0始まり)のファイルのパスを返す。分割しない場合は p のままとする。
+func shardPath(p string, i, n int) string {
+	if n <= 1 {
+		return p
+	}
+	ext := filepath.Ext(p)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(p, ext), i+1, ext)
+}
+
+// 分割した items ごとに、output へ再送信スクリプトを出力する。
+// base には、items と Folders 以外のデータを指定する。
+// 送信結果のCSVファイルのパスが未指定の場合は、スクリプトと同じ名前とする。
+func writeRecoveryScripts(output string, rw RecoveryWriter, base RecoveryScript, shards [][]RecoveryItem, createFolders bool) error {
+	for i, items := range shards {
+		p := shardPath(output, i, len(shards))
+
+		data := base
+		data.Output = p
+		data.Items = items
+		if base.LogPath == "" {
+			data.LogPath = strings.TrimSuffix(filepath.Base(p), filepath.Ext(p)) + ".log.csv"
+		} else {
+			data.LogPath = shardPath(base.LogPath, i, len(shards))
+		}
+
+		// 送信先フォルダがない場合に備えて、送信前にフォルダを作成する
+		if createFolders {
+			data.Folders = recoveryFolders(items)
+		}
+
+		fp, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		err = rw.Write(fp, &data)
+		fp.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// 分割した再送信スクリプトごとの件数と合計サイズを出力する。分割しない場合は何も出力しない。
+func printRecoveryShards(output string, shards [][]RecoveryItem) {
+	if len(shards) <= 1 {
+		return
+	}
+	for i, items := range shards {
+		var size int64
+		for _, item := range items {
+			size += int64(item.Size)
+		}
+		fmt.Printf("　→%s : %d 件, %d バイト\n", filepath.Base(shardPath(output, i, len(shards))), len(items), size)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 日本語や記号を含むファイル名
+var recoveryTestNames = []string{
+	"報告書.xlsx",
+	"見積書 (最終版).docx",
+	"a`b`c.txt",
+	`"引用".txt`,
+	"$(Remove-Item x).txt",
+	"$env:PATH.txt",
+	"it's.txt",
+	"’全角‘引用‚‛.txt",
+	"100%達成.pptx",
+	"#1 議事録.docx",
+	"ＡＢＣ　全角スペース％＃.txt",
+	"a;b&c|d<e>f.txt",
+}
+
+// PowerShell の単一引用符の文字列リテラル s の先頭から値を読み込み、値と残りの文字列を返す。
+func readPSLiteral(s string) (string, string, error) {
+	if !strings.HasPrefix(s, "'") {
+		return "", "", fmt.Errorf("単一引用符で始まっていません. %s", s)
+	}
+
+	var b strings.Builder
+	rs := []rune(s[1:])
+	for i := 0; i < len(rs); i++ {
+		switch rs[i] {
+		case '\'', '\u2018', '\u2019', '\u201a', '\u201b':
+			// 単一引用符が2つ続く場合はエスケープ、それ以外は文字列の終わり
+			if i+1 < len(rs) && strings.ContainsRune("'\u2018\u2019\u201a\u201b", rs[i+1]) {
+				b.WriteRune(rs[i])
+				i++
+				continue
+			}
+			return b.String(), string(rs[i+1:]), nil
+		}
+		b.WriteRune(rs[i])
+	}
+	return "", "", fmt.Errorf("単一引用符が閉じていません. %s", s)
+}
+
+func TestPsQuote(t *testing.T) {
+	for _, name := range recoveryTestNames {
+		q := psQuote(name)
+		v, rest, err := readPSLiteral(q)
+		if err != nil {
+			t.Errorf("psQuote(%q) = %s: %s", name, q, err)
+			continue
+		}
+		if v != name || rest != "" {
+			t.Errorf("psQuote(%q) = %s, 読み込み結果 %q, 残り %q", name, q, v, rest)
+		}
+	}
+}
+
+func TestSpoPathEscape(t *testing.T) {
+	for _, name := range recoveryTestNames {
+		p := "/Shared Documents/フォルダ #1/" + name
+		e := spoPathEscape(p)
+		if strings.ContainsAny(e, "# ") {
+			t.Errorf("spoPathEscape(%q) = %s, エンコードされていない文字があります", p, e)
+		}
+		v, err := url.PathUnescape(e)
+		if err != nil {
+			t.Errorf("spoPathEscape(%q) = %s: %s", p, e, err)
+			continue
+		}
+		if v != p {
+			t.Errorf("spoPathEscape(%q) = %s, デコード結果 %q", p, e, v)
+		}
+	}
+}
+
+// 既定のテンプレートで出力した再送信スクリプトを返す。
+func executeDefaultRecoveryTemplate(t *testing.T, data *RecoveryScript) string {
+	t.Helper()
+
+	w, err := newRecoveryWriter(recoveryBackendPnP, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := w.Write(&buf, data); err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimPrefix(buf.String(), "\ufeff")
+}
+
+// 再送信スクリプトのテスト用データを生成する。
+func newRecoveryTestScript() *RecoveryScript {
+	data := &RecoveryScript{SiteURL: "https://example.sharepoint.com/sites/pj", Library: "/Shared Documents", LogPath: "recovery's.csv"}
+	for _, name := range recoveryTestNames {
+		folder := "/フォルダ #1/" + name
+		data.Items = append(data.Items, RecoveryItem{Path: "C:/base/PJ/フォルダ #1/" + name + "/" + name, Folder: folder})
+		data.Folders = append(data.Folders, folder)
+	}
+	return data
+}
+
+func TestDefaultRecoveryTemplate(t *testing.T) {
+	data := newRecoveryTestScript()
+	script := executeDefaultRecoveryTemplate(t, data)
+
+	var folders, items int
+	for _, line := range strings.Split(script, "\n") {
+		switch {
+		case strings.HasPrefix(line, "Resolve-RecoveryFolder -Folder "):
+			v, rest, err := readPSLiteral(strings.TrimPrefix(line, "Resolve-RecoveryFolder -Folder "))
+			if err != nil || rest != "" {
+				t.Fatalf("フォルダの行を解析できません. %s: %v", line, err)
+			}
+			// Resolve-PnPFolder にはエンコードしないパスを渡す
+			if want := data.Library + data.Folders[folders]; v != want {
+				t.Errorf("Resolve-RecoveryFolder -Folder = %q, want %q", v, want)
+			}
+			folders++
+		case strings.HasPrefix(line, "Add-RecoveryFile -Path "):
+			path, rest, err := readPSLiteral(strings.TrimPrefix(line, "Add-RecoveryFile -Path "))
+			if err != nil || !strings.HasPrefix(rest, " -Folder ") {
+				t.Fatalf("ファイルの行を解析できません. %s: %v", line, err)
+			}
+			folder, rest, err := readPSLiteral(strings.TrimPrefix(rest, " -Folder "))
+			if err != nil || rest != "" {
+				t.Fatalf("ファイルの行を解析できません. %s: %v", line, err)
+			}
+			item := data.Items[items]
+			if path != item.Path {
+				t.Errorf("Add-RecoveryFile -Path = %q, want %q", path, item.Path)
+			}
+			// Add-PnPFile にはエンコードしたパスを渡す
+			if want := spoPathEscape(data.Library + item.Folder); folder != want {
+				t.Errorf("Add-RecoveryFile -Folder = %q, want %q", folder, want)
+			}
+			items++
+		}
+	}
+	if folders != len(data.Folders) || items != len(data.Items) {
+		t.Errorf("出力件数 フォルダ %d, ファイル %d, want %d, %d", folders, items, len(data.Folders), len(data.Items))
+	}
+}
+
+// PowerShell がある場合は、出力した再送信スクリプトを PowerShell のパーサーで解析する。
+func TestDefaultRecoveryTemplatePowerShellParse(t *testing.T) {
+	pwsh, err := exec.LookPath("pwsh")
+	if err != nil {
+		t.Skip("pwsh がないため、スキップします")
+	}
+
+	path := filepath.Join(t.TempDir(), "recovery.ps1")
+	if err := os.WriteFile(path, []byte(executeDefaultRecoveryTemplate(t, newRecoveryTestScript())), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := "$errors = $null; [System.Management.Automation.Language.Parser]::ParseFile(" + psQuote(path) + ", [ref]$null, [ref]$errors) | Out-Null; $errors | ForEach-Object { $_.Message }; exit $errors.Count"
+	out, err := exec.Command(pwsh, "-NoProfile", "-NonInteractive", "-Command", cmd).CombinedOutput()
+	if err != nil {
+		t.Errorf("PowerShell の構文エラー: %s\n%s", err, out)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// TEMPへの再コピースクリプトの出力形式
+const (
+	tempBackendRobocopy = "robocopy" // robocopy のバッチファイル
+	tempBackendRsync    = "rsync"    // rsync --files-from のシェルスクリプト
+)
+
+// rsync のスクリプトで、ファイルリストのヒアドキュメントの終わりを表す文字列
+const rsyncFilesDelimiter = "PJKAKUNINJA_FILES"
+
+// cmd.exe の1行の文字数の上限
+const robocopyCommandLimit = 8191
+
+// TEMPへの再コピー対象ファイル
+type TempRecoveryItem struct {
+	Dir  string // BASE_DIR からの格納フォルダの相対パス(区切りは「/」。BASE_DIR 直下の場合は空文字)
+	Name string // ファイル名
+}
+
+// BASE_DIR からの相対パスを返す。
+func (item TempRecoveryItem) rel() string {
+	if item.Dir == "" {
+		return item.Name
+	}
+	return item.Dir + "/" + item.Name
+}
+
+// r で指定された check-temp(または check-all)の結果ファイルから、再コピー対象ファイルを生成する。
+// SPO の段階の行、BASE_DIR(basePrefix)配下でない行、同じファイルの2行目以降はスキップする。
+// 改行(CR)を含むパスは、スクリプトの1行に出力できないためスキップする。
+func generateTempRecoveryItems(r io.Reader, basePrefix string) ([]TempRecoveryItem, uint, uint, error) {
+	var items []TempRecoveryItem
+	var read, skip uint
+	added := make(map[string]bool)
+
+	s := bufio.NewScanner(newBufioReader(r))
+	for s.Scan() {
+		read += 1
+		if s.Text() == "" {
+			skip += 1
+			continue
+		}
+
+		row, err := parseUnmatchLine(s.Text())
+		if err != nil {
+			return nil, read, skip, err
+		}
+
+		p := strings.Replace(row.path, "\\", "/", -1)
+		if row.stage == StageSPO || !strings.HasPrefix(strings.ToLower(p), strings.ToLower(basePrefix)) || strings.ContainsAny(p, "\r\n") {
+			skip += 1
+			continue
+		}
+		rel := p[len(basePrefix):]
+		if added[strings.ToLower(rel)] {
+			skip += 1
+			continue
+		}
+		added[strings.ToLower(rel)] = true
+
+		item := TempRecoveryItem{Name: rel}
+		if i := strings.LastIndex(rel, "/"); i >= 0 {
+			item = TempRecoveryItem{rel[:i], rel[i+1:]}
+		}
+		items = append(items, item)
+	}
+
+	if s.Err() != nil {
+		// non-EOF error.
+		return nil, read, skip, s.Err()
+	}
+
+	return items, read, skip, nil
+}
+
+// items を格納フォルダごとにまとめ、フォルダのパスの昇順に返す。
+// Windows はフォルダ名の大文字小文字を区別しないため、大文字小文字の違いは同じフォルダとする。
+func groupTempRecoveryItems(items []TempRecoveryItem) [][]TempRecoveryItem {
+	groups := make(map[string][]TempRecoveryItem)
+	var keys []string
+	for _, item := range items {
+		key := strings.ToLower(item.Dir)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], item)
+	}
+	sort.Strings(keys)
+
+	out := make([][]TempRecoveryItem, len(keys))
+	for i, k := range keys {
+		out[i] = groups[k]
+	}
+	return out
+}
+
+// バッチファイルの二重引用符の文字列に変換する。区切りは「\」とし、「%」はエスケープする。
+func cmdQuote(s string) string {
+	return "\"" + strings.Replace(strings.Replace(s, "/", "\\", -1), "%", "%%", -1) + "\""
+}
+
+// フォルダのパスを結合する。robocopy は「\"」を引用符のエスケープとみなすため、末尾の区切りは除く。
+func joinTempRecoveryDir(prefix, dir string) string {
+	return strings.TrimRight(prefix+dir, "/")
+}
+
+// w へ、格納フォルダごとに比較元フォルダ(sourcePrefix)から比較先フォルダ(basePrefix)へ
+// 再コピーする robocopy のバッチファイルを出力する。
+// コピー対象のファイルは /IF で指定し、1行の文字数が cmd.exe の上限を超える場合は複数の robocopy に分割する。
+// 同じサイズと更新日時のファイルもコピーするため、/IS と /IT を指定する。
+// 戻り値は、出力した robocopy の件数。
+func writeRobocopyScript(w io.Writer, items []TempRecoveryItem, sourcePrefix, basePrefix string) (int, error) {
+	var commands []string
+	for _, group := range groupTempRecoveryItems(items) {
+		head := fmt.Sprintf("robocopy %s %s /IF", cmdQuote(joinTempRecoveryDir(sourcePrefix, group[0].Dir)), cmdQuote(joinTempRecoveryDir(basePrefix, group[0].Dir)))
+		tail := " /IS /IT /R:3 /W:10 /NP /UNILOG+:\"%LOG%\""
+		// %LOG% の展開分として MAX_PATH(260文字)を見込む
+		limit := robocopyCommandLimit - len(tail) - 260
+
+		line := head
+		for _, item := range group {
+			name := " " + cmdQuote(item.Name)
+			if line != head && len(line)+len(name) > limit {
+				commands = append(commands, line+tail)
+				line = head
+			}
+			line += name
+		}
+		commands = append(commands, line+tail)
+	}
+
+	bw := bufio.NewWriter(w)
+	lines := []string{
+		"@echo off",
+		"rem pjkakuninja recovery-temp で生成したTEMPへの再コピースクリプト",
+		"chcp 65001 > nul",
+		"set LOG=%~dpn0.log",
+		"set FAILURE=0",
+		"",
+	}
+	for _, c := range commands {
+		lines = append(lines, c, "if errorlevel 8 set /a FAILURE+=1")
+	}
+	lines = append(lines,
+		"",
+		fmt.Sprintf("echo robocopy : %d 件", len(commands)),
+		"echo 失敗 : %FAILURE% 件",
+		"echo コピー結果 : %LOG%",
+	)
+	for _, l := range lines {
+		// バッチファイルの改行は CRLF とする
+		if _, err := bw.WriteString(l + "\r\n"); err != nil {
+			return 0, err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+
+	return len(commands), nil
+}
+
+// w へ、比較元フォルダ(sourcePrefix)から比較先フォルダ(basePrefix)へ
+// rsync --files-from で再コピーするシェルスクリプトを出力する。
+// 同じサイズと更新日時のファイルもコピーするため、--ignore-times を指定する。
+// 改行を含むパスは、generateTempRecoveryItems でスキップ済みとする。
+func writeRsyncScript(w io.Writer, items []TempRecoveryItem, sourcePrefix, basePrefix string) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "#!/bin/bash")
+	fmt.Fprintln(bw, "# pjkakuninja recovery-temp で生成したTEMPへの再コピースクリプト")
+	fmt.Fprintln(bw, "")
+	fmt.Fprintf(bw, "rsync -a --ignore-times --files-from=- --log-file=\"${0%%.*}.log\" %s %s <<'%s'\n", shQuote(sourcePrefix), shQuote(basePrefix), rsyncFilesDelimiter)
+	for _, item := range items {
+		rel := item.rel()
+		// ヒアドキュメントの終わりと区別できるように、「./」を付加する
+		if rel == rsyncFilesDelimiter {
+			rel = "./" + rel
+		}
+		fmt.Fprintln(bw, rel)
+	}
+	fmt.Fprintln(bw, rsyncFilesDelimiter)
+	if _, err := fmt.Fprintln(bw, "exit $?"); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// 再送信スクリプトの出力形式
+const (
+	recoveryBackendPnP    = "pnp"    // PnP PowerShell のスクリプト
+	recoveryBackendM365   = "m365"   // CLI for Microsoft 365 のシェルスクリプト
+	recoveryBackendRclone = "rclone" // rclone copy --files-from-raw のファイルリスト
+	recoveryBackendGraph  = "graph"  // Microsoft Graph のアップロードセッション作成のバッチリクエスト(JSON)
+)
+
+// Microsoft Graph の1回のバッチリクエストに含められるリクエスト数の上限
+const graphBatchLimit = 20
+
+// backend の形式で出力する RecoveryWriter を生成する。
+// templatePath は pnp と m365、remote は rclone、driveID は graph で使用する。
+func newRecoveryWriter(backend, templatePath, remote, driveID string) (RecoveryWriter, error) {
+	switch backend {
+	case recoveryBackendPnP:
+		t, err := newRecoveryTemplate(templatePath, defaultRecoveryTemplate)
+		if err != nil {
+			return nil, err
+		}
+		return &templateRecoveryWriter{t, true}, nil
+	case recoveryBackendM365:
+		t, err := newRecoveryTemplate(templatePath, defaultM365RecoveryTemplate)
+		if err != nil {
+			return nil, err
+		}
+		return &templateRecoveryWriter{t, false}, nil
+	case recoveryBackendRclone:
+		if remote == "" {
+			return nil, fmt.Errorf("rclone のリモート名を指定してください")
+		}
+		return &rcloneRecoveryWriter{remote}, nil
+	case recoveryBackendGraph:
+		if driveID == "" {
+			return nil, fmt.Errorf("ドライブID(DRIVE_ID)を指定してください")
+		}
+		return &graphRecoveryWriter{driveID}, nil
+	}
+	return nil, fmt.Errorf("再送信スクリプトの出力形式が不正です. BACKEND=%s", backend)
+}
+
+// シェルの単一引用符の文字列リテラルに変換する。
+// 単一引用符の文字列では何もエスケープできないため、単一引用符は一度引用を閉じ、エスケープしてから再度引用を開始する。
+func shQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// CLI for Microsoft 365 の再送信スクリプトのテンプレート
+// m365 spo file add は送信先フォルダがない場合に作成するため、フォルダの作成は出力しない。
+const defaultM365RecoveryTemplate = `#!/bin/bash
+# pjkakuninja recovery-spo で生成したSPOへの再送信スクリプト(CLI for Microsoft 365)
+# 実行前に m365 login でサインインしてください。
+
+web_url={{sh .SiteURL}}
+log={{sh .LogPath}}
+case "$log" in
+    /*) ;;
+    *) log="$(dirname "$0")/$log" ;;
+esac
+echo "Result,Path,Folder,Message" > "$log"
+
+success=0
+failure=0
+
+csv_value() {
+    local v="${1//\"/\"\"}"
+    printf '"%s"' "${v//$'\n'/ }"
+}
+
+write_recovery_log() {
+    echo "$1,$(csv_value "$2"),$(csv_value "$3"),$(csv_value "$4")" >> "$log"
+}
+
+add_recovery_file() {
+    local message
+    if message=$(m365 spo file add --webUrl "$web_url" --folder "$2" --path "$1" 2>&1); then
+        write_recovery_log "Success" "$1" "$2" ""
+        success=$((success + 1))
+    else
+        write_recovery_log "Failure" "$1" "$2" "$message"
+        failure=$((failure + 1))
+    fi
+}
+
+{{range .Items -}}
+add_recovery_file {{sh .Path}} {{sh (print $.Library .Folder)}}
+{{end}}
+echo "成功 : $success 件"
+echo "失敗 : $failure 件"
+echo "送信結果 : $log"
+`
+
+// rclone copy --files-from-raw で使用するファイルリストを出力する
+type rcloneRecoveryWriter struct {
+	remote string // SPO のライブラリを設定した rclone のリモート名。リモートのルートはライブラリのルートとなる
+}
+
+// w へ、送信元フォルダからの相対パスのファイルリストを出力する。
+// 送信元フォルダは、ファイルパスの送信先フォルダ(SPO_PATH 以降)に対応する部分より前とし、すべてのファイルで同じであること。
+// 実行する rclone copy のコマンドを標準出力に出力する。
+func (p *rcloneRecoveryWriter) Write(w io.Writer, data *RecoveryScript) error {
+	if len(data.Items) == 0 {
+		return nil
+	}
+
+	base, root := data.Items[0].Base, data.Items[0].Root
+	bw := bufio.NewWriter(w)
+	for _, item := range data.Items {
+		if item.Base != base || item.Root != root {
+			return fmt.Errorf("送信元フォルダが異なるファイルは同じファイルリストに出力できません. %s, %s", base, item.Base)
+		}
+		if _, err := bw.WriteString(item.Path[len(item.Base)+1:] + "\n"); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("　→rclone copy --files-from-raw %s %s %s\n", shQuote(data.Output), shQuote(base), shQuote(p.remote+":"+root))
+	return nil
+}
+
+// Microsoft Graph のアップロードセッションの作成のバッチリクエストを出力する
+type graphRecoveryWriter struct {
+	driveID string // 送信先のライブラリのドライブID
+}
+
+// Microsoft Graph のバッチリクエストの1リクエスト
+type graphBatchRequest struct {
+	ID      string            `json:"id"`
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Body    interface{}       `json:"body"`
+}
+
+// Microsoft Graph のバッチリクエスト($batch の本文)
+type graphBatch struct {
+	Requests []graphBatchRequest `json:"requests"`
+}
+
+// バッチリクエストのリクエストIDと送信するファイルの対応
+type graphBatchFile struct {
+	ID     string `json:"id"`
+	Batch  int    `json:"batch"`  // バッチのインデックス(0始まり)
+	Path   string `json:"path"`   // 送信するファイルのパス
+	Target string `json:"target"` // 送信先のドライブのルートからのパス
+	Size   int    `json:"size"`   // ファイルサイズ。不明な場合は 0
+}
+
+// graphRecoveryWriter が出力するJSON
+type graphRecovery struct {
+	DriveID string           `json:"driveId"`
+	Batches []graphBatch     `json:"batches"`
+	Files   []graphBatchFile `json:"files"`
+}
+
+// 再送信対象ファイル item の送信先のドライブのルートからのパスを返す。
+func graphTarget(item RecoveryItem) string {
+	return item.Folder + item.Path[strings.LastIndex(item.Path, "/"):]
+}
+
+// ドライブのルートからのパス p を、Microsoft Graph のパスとして要素ごとにエンコードする。
+func graphPathEscape(p string) string {
+	ary := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for i, s := range ary {
+		ary[i] = url.PathEscape(s)
+	}
+	return strings.Join(ary, "/")
+}
+
+// w へ、ファイルごとのアップロードセッションを作成するバッチリクエストを出力する。
+// アップロードセッションの作成時に送信先フォルダがない場合は作成されるため、フォルダの作成は出力しない。
+// ファイルの内容の送信は、作成されたアップロードセッションの uploadUrl に対して別途行う。
+func (p *graphRecoveryWriter) Write(w io.Writer, data *RecoveryScript) error {
+	out := graphRecovery{DriveID: p.driveID, Batches: []graphBatch{}, Files: []graphBatchFile{}}
+
+	body := map[string]interface{}{
+		"item": map[string]string{"@microsoft.graph.conflictBehavior": "replace"},
+	}
+	for i, item := range data.Items {
+		if i%graphBatchLimit == 0 {
+			out.Batches = append(out.Batches, graphBatch{})
+		}
+		b := len(out.Batches) - 1
+
+		id := fmt.Sprint(i + 1)
+		target := graphTarget(item)
+		out.Batches[b].Requests = append(out.Batches[b].Requests, graphBatchRequest{
+			ID:      id,
+			Method:  "POST",
+			URL:     fmt.Sprintf("/drives/%s/root:/%s:/createUploadSession", url.PathEscape(p.driveID), graphPathEscape(target)),
+			Headers: map[string]string{"Content-Type": "application/json"},
+			Body:    body,
+		})
+		out.Files = append(out.Files, graphBatchFile{id, b, item.Path, target, item.Size})
+	}
+
+	e := json.NewEncoder(w)
+	e.SetEscapeHTML(false)
+	e.SetIndent("", "  ")
+	return e.Encode(out)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 単位あたりの処理量を制限する
+// 処理量に応じて次に処理できる時刻を予約し、その時刻まで待機する。
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate float64   // 1秒あたりの処理量
+	next time.Time // 次に処理できる時刻
+}
+
+// 1秒あたりの処理量 rate で制限する。rate が 0 以下の場合は nil を返す(制限しない)。
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate}
+}
+
+// 処理量 n を処理できるまで待機する。
+func (l *rateLimiter) wait(n int64) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	d := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	l.mu.Unlock()
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// 読み込んだバイト数に応じて待機する Reader
+type rateLimitedReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.l.wait(int64(n))
+	return n, err
+}
+
+// ハッシュ値を計算する関数 hashFunc の読み込みを、l で制限する。
+func rateLimitedHashFunc(hashFunc func(r io.Reader) (string, error), l *rateLimiter) func(r io.Reader) (string, error) {
+	if hashFunc == nil || l == nil {
+		return hashFunc
+	}
+	return func(r io.Reader) (string, error) {
+		return hashFunc(&rateLimitedReader{r: r, l: l})
+	}
+}
+
+// 数値 s をバイト数に変換する。K, M, G の単位(1024倍)を付加できる。
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("バイト数の指定が不正です. BYTES=%s", s)
+	}
+	return n * unit, nil
+}
+
+// 処理を許可する時間帯
+// 開始時刻が終了時刻より後の場合は、日付をまたぐ時間帯(例: 20:00-07:00)とする。
+type schedule struct {
+	mu    sync.Mutex
+	start int // 開始時刻(0時からの分)
+	end   int // 終了時刻(0時からの分)
+}
+
+var scheduleRegexp = regexp.MustCompile(`^(\d{1,2}):(\d{2})-(\d{1,2}):(\d{2})$`)
+
+// 「HH:MM-HH:MM」形式の時間帯 s を解析する。s が空文字の場合は nil を返す(常に許可する)。
+func parseSchedule(s string) (*schedule, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	m := scheduleRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return nil, fmt.Errorf("時間帯の指定が不正です. SCHEDULE=%s", s)
+	}
+	var v [4]int
+	for i := range v {
+		v[i], _ = strconv.Atoi(m[i+1])
+	}
+	if v[0] > 23 || v[1] > 59 || v[2] > 24 || v[3] > 59 || (v[2] == 24 && v[3] != 0) {
+		return nil, fmt.Errorf("時間帯の指定が不正です. SCHEDULE=%s", s)
+	}
+
+	sc := &schedule{start: v[0]*60 + v[1], end: v[2]*60 + v[3]}
+	if sc.start == sc.end {
+		return nil, fmt.Errorf("時間帯の開始時刻と終了時刻が同じです. SCHEDULE=%s", s)
+	}
+	return sc, nil
+}
+
+// 時刻 t が許可する時間帯の場合 true を返す。
+func (s *schedule) allowed(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if s.start < s.end {
+		return s.start <= m && m < s.end
+	}
+	return s.start <= m || m < s.end
+}
+
+// 時刻 t の次に許可する時間帯が始まる時刻を返す。
+func (s *schedule) nextStart(t time.Time) time.Time {
+	start := time.Date(t.Year(), t.Month(), t.Day(), s.start/60, s.start%60, 0, 0, t.Location())
+	if !start.After(t) {
+		start = start.AddDate(0, 0, 1)
+	}
+	return start
+}
+
+// 許可する時間帯になるまで待機する。
+func (s *schedule) wait() {
+	if s == nil {
+		return
+	}
+
+	// 待機中は他のゴルーチンも待機させる
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.allowed(now) {
+		return
+	}
+
+	next := s.nextStart(now)
+	fmt.Printf("◆許可された時間帯外のため、探索を一時停止します。(再開予定 : %s)\n", next.Format("2006/01/02 15:04"))
+	for !s.allowed(now) {
+		// 時刻の変更やスリープからの復帰に備え、1分ごとに確認する
+		d := next.Sub(now)
+		if d > time.Minute {
+			d = time.Minute
+		}
+		time.Sleep(d)
+		now = time.Now()
+	}
+	fmt.Println("◆探索を再開します。")
+}
+
+// 探索の負荷を制限する
+type walkThrottle struct {
+	concurrent int          // フォルダを並行して探索する数。0 の場合は walker の既定値
+	running    int32        // 探索中に追加で起動したゴルーチン数。シンボリックリンクのリンク先の探索を含め、探索全体で共有する
+	files      *rateLimiter // 1秒あたりのファイル数の制限
+	schedule   *schedule    // 探索を許可する時間帯
+}
+
+// ファイル(フォルダ)を1件処理できるまで待機する。
+func (t *walkThrottle) wait() {
+	if t == nil {
+		return
+	}
+	t.schedule.wait()
+	t.files.wait(1)
+}
+
+// dir 配下を、呼び出し元を含めて最大 limit 個のゴルーチンで探索する。
+// walker.Walk と同様に、dir 自身を含むファイルとフォルダごとに fn を呼び出し、
+// フォルダを読み込めなかった場合は errorCallback を呼び出す。
+// running は追加で起動したゴルーチン数で、fn の中から walkLimited を呼び出す場合は同じものを渡して上限を共有する。
+func walkLimited(dir string, limit int, running *int32, fn func(pathname string, info os.FileInfo) error, errorCallback func(pathname string, err error) error) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if err = fn(dir, info); err == filepath.SkipDir {
+		return nil
+	}
+	if err != nil || !info.IsDir() {
+		return err
+	}
+
+	// 呼び出し元のゴルーチンでも探索し、上限の残りの分だけゴルーチンを追加で起動する
+	w := &limitedWalker{running: running, limit: int32(limit) - 1, fn: fn, errorCallback: errorCallback}
+	w.setErr(w.walkDir(dir))
+	w.wg.Wait()
+
+	return w.err
+}
+
+type limitedWalker struct {
+	running       *int32 // 追加で起動したゴルーチン数
+	limit         int32  // 追加で起動するゴルーチン数の上限
+	fn            func(pathname string, info os.FileInfo) error
+	errorCallback func(pathname string, err error) error
+	wg            sync.WaitGroup
+	mu            sync.Mutex
+	err           error // 最初に発生したエラー
+}
+
+func (w *limitedWalker) failed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err != nil
+}
+
+// 最初に発生したエラーを記録する。
+func (w *limitedWalker) setErr(err error) {
+	if err == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *limitedWalker) gowalk(dir string) {
+	defer w.wg.Done()
+	defer atomic.AddInt32(w.running, -1)
+
+	w.setErr(w.walkDir(dir))
+}
+
+// フォルダ dir を読み込み、エントリごとに fn を呼び出す。
+func (w *limitedWalker) walkDir(dir string) error {
+	err := w.readdir(dir)
+	if err != nil && w.errorCallback != nil {
+		err = w.errorCallback(dir, err)
+	}
+	return err
+}
+
+func (w *limitedWalker) readdir(dir string) error {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	list, err := fp.Readdir(-1)
+	fp.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, info := range list {
+		if w.failed() {
+			return nil
+		}
+
+		p := dir + string(filepath.Separator) + info.Name()
+		err := w.fn(p, info)
+		if err == filepath.SkipDir {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 || !info.IsDir() {
+			continue
+		}
+
+		// 上限に達していなければ新しいゴルーチンで探索し、達していればこのゴルーチンで探索する
+		current := atomic.LoadInt32(w.running)
+		if current < w.limit && atomic.CompareAndSwapInt32(w.running, current, current+1) {
+			w.wg.Add(1)
+			go w.gowalk(p)
+			continue
+		}
+		if err := w.walkDir(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}